@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// The metadata callers' identity is forwarded to the backends in. Any sent
+// by callers themselves is dropped, so it can't be forged.
+const (
+	subjectMetadata = "x-auth-subject"
+	scopesMetadata  = "x-auth-scopes"
+	methodMetadata  = "x-auth-method"
+)
+
+const (
+	// apiKeyHeader is the header callers send their API key in.
+	apiKeyHeader = "X-API-Key"
+
+	// authChallenge is the WWW-Authenticate header of responses refusing
+	// unauthenticated callers.
+	authChallenge = `Bearer realm="api"`
+)
+
+// errNoCredentials is the authentication error of requests which carry no
+// credentials at all.
+var errNoCredentials = errors.New("missing credentials, send an API key in " + apiKeyHeader + " or a bearer token in Authorization")
+
+// identity is who a caller authenticated as.
+type identity struct {
+	subject string
+	scopes  []string
+
+	// method is how they authenticated, e.g. "api-key" or "jwt".
+	method string
+}
+
+// authenticator identifies callers by one kind of credential.
+type authenticator interface {
+	// authenticate returns the identity r was made with. It returns
+	// errNoCredentials if r carries no credential of its kind, so another
+	// authenticator can be tried.
+	authenticate(r *http.Request) (*identity, error)
+}
+
+// authKey is the context key holding the outcome of authenticating a
+// request.
+type authKey struct{}
+
+// authResult is the outcome of authenticating a request.
+type authResult struct {
+	id  *identity
+	err error
+}
+
+// withAuth authenticates requests with the first of authenticators to find
+// credentials it understands. It doesn't refuse any, as which need
+// authenticating is up to the backends' interceptors, so probes can still be
+// answered, and refusals are reported like any other gateway error.
+func withAuth(authenticators []authenticator, next http.Handler) http.Handler {
+	if len(authenticators) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := &authResult{err: errNoCredentials}
+		for _, a := range authenticators {
+			result.id, result.err = a.authenticate(r)
+			if result.err != errNoCredentials {
+				break
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey{}, result)))
+	})
+}
+
+// unaryIdentity forwards the caller's identity on unary calls to a backend,
+// failing them with Unauthenticated if the caller couldn't be identified.
+func unaryIdentity(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, err := forwardIdentity(ctx, method)
+	if err != nil {
+		return err
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamIdentity forwards the caller's identity on streams, like
+// unaryIdentity.
+func streamIdentity(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, err := forwardIdentity(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// forwardIdentity replaces any identity metadata in ctx with the identity of
+// the request it serves. When authentication is off nothing is forwarded.
+// Health checks are made by the gateway itself, so go unauthenticated.
+func forwardIdentity(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	md.Delete(subjectMetadata)
+	md.Delete(scopesMetadata)
+	md.Delete(methodMetadata)
+
+	result, ok := ctx.Value(authKey{}).(*authResult)
+	if ok && !strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		if result.err != nil {
+			return nil, status.Error(codes.Unauthenticated, result.err.Error())
+		}
+
+		md.Set(subjectMetadata, result.id.subject)
+		md.Set(scopesMetadata, strings.Join(result.id.scopes, " "))
+		md.Set(methodMetadata, result.id.method)
+	}
+
+	return metadata.NewOutgoingContext(ctx, md), nil
+}
+
+// authErrorHandler challenges callers refused as Unauthenticated to present
+// credentials, before handling the error as usual.
+func authErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	if status.Code(err) == codes.Unauthenticated {
+		w = &challengeWriter{ResponseWriter: w}
+	}
+
+	etagErrorHandler(ctx, mux, m, w, r, err)
+}
+
+// challengeWriter sets the WWW-Authenticate header as the response is
+// written, replacing the error message the gateway puts there by default.
+type challengeWriter struct {
+	http.ResponseWriter
+}
+
+func (w *challengeWriter) WriteHeader(status int) {
+	w.Header().Set("WWW-Authenticate", authChallenge)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// apiKeys authenticates callers by static API keys, sent in the X-API-Key
+// header.
+type apiKeys struct {
+	// ids are the identities of each key, by its SHA-256 hash, so looking
+	// a key up doesn't leak how much of it was right.
+	ids map[[sha256.Size]byte]*identity
+}
+
+// apiKeysFile is the YAML or JSON file API keys are read from.
+type apiKeysFile struct {
+	Keys []struct {
+		Key     string   `yaml:"key"`
+		Subject string   `yaml:"subject"`
+		Scopes  []string `yaml:"scopes"`
+	} `yaml:"keys"`
+}
+
+// loadAPIKeys reads API keys from the file at path.
+func loadAPIKeys(path string) (*apiKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file apiKeysFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed parsing API keys %s: %w", path, err)
+	}
+
+	keys := &apiKeys{ids: make(map[[sha256.Size]byte]*identity, len(file.Keys))}
+	for i, k := range file.Keys {
+		if k.Key == "" || k.Subject == "" {
+			return nil, fmt.Errorf("API key %d in %s needs a key and a subject", i+1, path)
+		}
+
+		hash := sha256.Sum256([]byte(k.Key))
+		if _, ok := keys.ids[hash]; ok {
+			return nil, fmt.Errorf("API key %d in %s is a duplicate", i+1, path)
+		}
+
+		keys.ids[hash] = &identity{subject: k.Subject, scopes: k.Scopes, method: "api-key"}
+	}
+
+	return keys, nil
+}
+
+func (k *apiKeys) authenticate(r *http.Request) (*identity, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, errNoCredentials
+	}
+
+	id, ok := k.ids[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+
+	return id, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"git.neds.sh/matty/entain/internal/platform/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// envPrefix prefixes the environment variable each flag can be set with,
+// e.g. API_API_ENDPOINT for --api-endpoint.
+const envPrefix = "API_"
+
+var (
+	configFile = flag.String(config.FileFlag, "", "YAML or JSON file of settings, keyed by flag name (also "+envPrefix+"CONFIG)")
+	logLevel   = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+)
+
+// secretFlags are flags whose values are redacted when logged.
+var secretFlags = map[string]bool{}
+
+// loadConfig fills in flags not given on the command line, from environment
+// variables and then the config file, and validates them. It must be called
+// after flag.Parse.
+func loadConfig() error {
+	if err := config.Load(flag.CommandLine, envPrefix); err != nil {
+		return err
+	}
+
+	return validateConfig()
+}
+
+// validateConfig checks settings which are well formed, but may not make
+// sense together, and applies --log-level.
+func validateConfig() error {
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	log.SetLevel(level)
+
+	for name, endpoint := range map[string]string{
+		"api-endpoint":         *apiEndpoint,
+		"racing-grpc-endpoint": *racingGRPCEndpoint,
+		"sports-grpc-endpoint": *sportsGRPCEndpoint,
+		"metrics-endpoint":     *metricsEndpoint,
+	} {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return fmt.Errorf("invalid --%s: %w", name, err)
+		}
+	}
+
+	switch *traceExporter {
+	case "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("invalid --trace-exporter %q, expected none, stdout or otlp", *traceExporter)
+	}
+
+	if *streamHeartbeat <= 0 {
+		return fmt.Errorf("invalid --stream-heartbeat %s, must be positive", *streamHeartbeat)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+	if (*racingTLSCert == "") != (*racingTLSKey == "") {
+		return fmt.Errorf("--racing-tls-cert and --racing-tls-key must be set together")
+	}
+	if *racingTLSCA == "" && (*racingTLSCert != "" || *racingTLSName != "") {
+		return fmt.Errorf("--racing-tls-cert and --racing-tls-server-name need --racing-tls-ca, to connect over TLS")
+	}
+
+	if *authJWKS == "" && (*authJWTIssuer != "" || *authJWTAudience != "") {
+		return fmt.Errorf("--auth-jwt-issuer and --auth-jwt-audience need --auth-jwks, to verify bearer tokens")
+	}
+
+	if *shutdownDelay < 0 || *shutdownTimeout < 0 {
+		return fmt.Errorf("--shutdown-delay and --shutdown-timeout can't be negative")
+	}
+	if *readHeaderTimeout < 0 || *readTimeout < 0 || *writeTimeout < 0 || *idleTimeout < 0 {
+		return fmt.Errorf("--read-header-timeout, --read-timeout, --write-timeout and --idle-timeout can't be negative")
+	}
+
+	return nil
+}
+
+// logConfig logs the value of every setting, with secrets redacted.
+func logConfig() {
+	config.Log(flag.CommandLine, redact)
+}
+
+// redact hides the value of secret settings.
+func redact(name, value string) string {
+	if value != "" && secretFlags[name] {
+		return "REDACTED"
+	}
+
+	return value
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// racesPath prefixes the path of every single race resource.
+const racesPath = "/v1/races/"
+
+// setETag is a forward response option which exposes a race's etag as the
+// HTTP ETag header.
+func setETag(ctx context.Context, w http.ResponseWriter, msg proto.Message) error {
+	if race, ok := msg.(*racing.Race); ok && race.Etag != "" {
+		w.Header().Set("ETag", strconv.Quote(race.Etag))
+	}
+
+	return nil
+}
+
+// etagErrorHandler reports a failed If-Match as 412 Precondition Failed:
+// a stale etag, rather than the 409 Conflict the gateway maps Aborted onto by
+// default, and a missing race, which no If-Match can match.
+func etagErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	if r.Header.Get("If-Match") != "" {
+		switch status.Code(err) {
+		case codes.Aborted, codes.NotFound:
+			w = &statusOverrideWriter{ResponseWriter: w, status: http.StatusPreconditionFailed}
+		}
+	}
+
+	runtime.DefaultHTTPErrorHandler(ctx, mux, m, w, r, err)
+}
+
+// statusOverrideWriter replaces the status code a response is written with.
+type statusOverrideWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusOverrideWriter) WriteHeader(int) {
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+// withConditionalRequests translates the HTTP conditional request headers
+// on single race resources: If-Match is passed to UpdateRace and DeleteRace
+// as the etag they are conditional on, and a GET whose If-None-Match holds
+// the race's current etag is answered with 304 Not Modified.
+func withConditionalRequests(mux *runtime.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRacePath(r.URL.Path) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPatch, http.MethodDelete:
+			if r.Header.Get("If-Match") == "" {
+				break
+			}
+
+			etag, ok := ifMatch(mux, r)
+			if !ok {
+				_, outbound := runtime.MarshalerForRequest(mux, r)
+				runtime.HTTPError(r.Context(), mux, outbound, w, r, status.Error(codes.Aborted, "race does not match If-Match"))
+				return
+			}
+			if etag == "" {
+				break
+			}
+
+			if r.Method == http.MethodPatch {
+				if err := setBodyETag(r, etag); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			} else {
+				query := r.URL.Query()
+				query.Set("etag", etag)
+				r.URL.RawQuery = query.Encode()
+			}
+		case http.MethodGet:
+			if r.Header.Get("If-None-Match") != "" {
+				serveIfNoneMatch(mux, w, r)
+				return
+			}
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// isRacePath reports whether path names a single race, e.g. /v1/races/1.
+func isRacePath(path string) bool {
+	id := strings.TrimPrefix(path, racesPath)
+
+	return id != path && id != "" && !strings.Contains(id, "/")
+}
+
+// ifMatch returns the etag a write must be conditional on to honour the
+// request's If-Match header, or "" if it's "*" and any version will do. ok
+// is false when no version of the race could match, as If-Match compares
+// strongly, so weak etags never match.
+//
+// The racing service takes a single etag, so when several are listed the
+// race is fetched to pick the current one. The write is still conditional on
+// it, in case the race changes in the meantime.
+func ifMatch(mux *runtime.ServeMux, r *http.Request) (etag string, ok bool) {
+	var strong []string
+	for _, tag := range parseETags(r.Header.Get("If-Match")) {
+		switch {
+		case tag.opaque == "*":
+			return "", true
+		case !tag.weak:
+			strong = append(strong, tag.opaque)
+		}
+	}
+
+	switch len(strong) {
+	case 0:
+		return "", false
+	case 1:
+		return strong[0], true
+	}
+
+	current, found, err := currentETag(mux, r)
+	switch {
+	case err != nil:
+		// Let the racing service decide, against one of them.
+		return strong[0], true
+	case !found:
+		return "", false
+	}
+
+	for _, etag := range strong {
+		if etag == current {
+			return etag, true
+		}
+	}
+
+	return "", false
+}
+
+// currentETag fetches the race named by a request's path, returning its
+// etag, or found false if there's no such race.
+func currentETag(mux *runtime.ServeMux, r *http.Request) (etag string, found bool, err error) {
+	get := r.Clone(r.Context())
+	get.Method = http.MethodGet
+	get.URL.RawQuery = ""
+	get.Body = http.NoBody
+	get.ContentLength = 0
+	get.Header.Del("If-Match")
+	get.Header.Del("If-None-Match")
+
+	rec := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	mux.ServeHTTP(rec, get)
+
+	switch rec.status {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", false, nil
+	default:
+		return "", false, fmt.Errorf("fetching race: %d %s", rec.status, rec.body.String())
+	}
+
+	tags := parseETags(rec.header.Get("ETag"))
+	if len(tags) != 1 {
+		return "", false, fmt.Errorf("race has no etag")
+	}
+
+	return tags[0].opaque, true, nil
+}
+
+// entityTag is an entity tag from an ETag, If-Match or If-None-Match header.
+type entityTag struct {
+	// opaque is the tag without its quotes, or "*".
+	opaque string
+	weak   bool
+}
+
+// parseETags splits an If-Match or If-None-Match header into the entity
+// tags it lists.
+func parseETags(header string) []entityTag {
+	var tags []entityTag
+
+	for _, field := range strings.Split(header, ",") {
+		field = strings.TrimSpace(field)
+
+		var tag entityTag
+		if strings.HasPrefix(field, "W/") {
+			tag.weak = true
+			field = strings.TrimPrefix(field, "W/")
+		}
+
+		tag.opaque = strings.Trim(field, `"`)
+		if tag.opaque != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// setBodyETag sets the etag field of the race in a PATCH request's body.
+func setBodyETag(r *http.Request, etag string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+
+	race := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &race); err != nil {
+			return err
+		}
+	}
+
+	race["etag"], err = json.Marshal(etag)
+	if err != nil {
+		return err
+	}
+
+	body, err = json.Marshal(race)
+	if err != nil {
+		return err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return nil
+}
+
+// serveIfNoneMatch buffers the response to a GET, so that it can be
+// replaced with 304 Not Modified when the race is unchanged.
+func serveIfNoneMatch(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	rec := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+
+	if rec.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), rec.header.Get("ETag")) {
+		w.Header().Del("Content-Type")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// weak comparison as RFC 7232 requires, i.e. ignoring whether either is weak.
+func etagMatches(header, etag string) bool {
+	current := parseETags(etag)
+	if len(current) == 0 {
+		return false
+	}
+
+	for _, candidate := range parseETags(header) {
+		if candidate.opaque == "*" || candidate.opaque == current[0].opaque {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bufferedWriter holds a response in memory.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// etagRacingServer holds races, whose etags are their version, enforcing
+// the etags writes are conditional on as the racing service does.
+type etagRacingServer struct {
+	racing.UnimplementedRacingServer
+
+	mu    sync.Mutex
+	races map[int64]*racing.Race
+
+	// writes records the etag each write was conditional on.
+	writes []string
+}
+
+func newETagRacingServer() *etagRacingServer {
+	return &etagRacingServer{races: map[int64]*racing.Race{
+		1: {Id: 1, Name: "Alpha", Etag: "1"},
+	}}
+}
+
+func (s *etagRacingServer) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	race, ok := s.races[in.Id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", in.Id)
+	}
+
+	return race, nil
+}
+
+func (s *etagRacingServer) UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.Race, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes = append(s.writes, in.Race.Etag)
+
+	race, err := s.current(in.Race.Id, in.Race.Etag)
+	if err != nil {
+		return nil, err
+	}
+
+	race.Name = in.Race.Name
+	race.Etag = bumpETag(race.Etag)
+
+	return race, nil
+}
+
+func (s *etagRacingServer) DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes = append(s.writes, in.Etag)
+
+	if _, err := s.current(in.Id, in.Etag); err != nil {
+		return nil, err
+	}
+
+	delete(s.races, in.Id)
+
+	return &emptypb.Empty{}, nil
+}
+
+// current returns the race with id, provided etag is empty or current. The
+// caller must hold the lock.
+func (s *etagRacingServer) current(id int64, etag string) (*racing.Race, error) {
+	race, ok := s.races[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", id)
+	}
+
+	if etag != "" && etag != race.Etag {
+		return nil, status.Errorf(codes.Aborted, "race %d has changed", id)
+	}
+
+	return race, nil
+}
+
+func bumpETag(etag string) string {
+	version, _ := strconv.Atoi(etag)
+
+	return strconv.Itoa(version + 1)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+
+		status int
+		etag   string
+
+		// writes are the etags writes reaching the racing service were
+		// conditional on.
+		writes []string
+
+		// contains must be contained in the response body.
+		contains string
+	}{
+		{
+			name:   "PATCH with the current etag",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header:   map[string]string{"If-Match": `"1"`},
+			status:   http.StatusOK,
+			etag:     `"2"`,
+			writes:   []string{"1"},
+			contains: `"name":"Bravo"`,
+		},
+		{
+			name:   "PATCH with a stale etag",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `"0"`},
+			status: http.StatusPreconditionFailed,
+			writes: []string{"0"},
+		},
+		{
+			name:   "PATCH with a weak etag",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `W/"1"`},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "PATCH with a list including the current etag",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `"0", W/"1", "1"`},
+			status: http.StatusOK,
+			etag:   `"2"`,
+			writes: []string{"1"},
+		},
+		{
+			name:   "PATCH with a list of stale etags",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `"0", "5"`},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "PATCH with a list for a missing race",
+			method: http.MethodPatch, path: "/v1/races/9", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `"0", "1"`},
+			status: http.StatusPreconditionFailed,
+		},
+		{
+			name:   "PATCH with any etag",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `*`},
+			status: http.StatusOK,
+			writes: []string{""},
+		},
+		{
+			name:   "PATCH with any etag for a missing race",
+			method: http.MethodPatch, path: "/v1/races/9", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `*`},
+			status: http.StatusPreconditionFailed,
+			writes: []string{""},
+		},
+		{
+			name:   "PATCH with an etag for a missing race",
+			method: http.MethodPatch, path: "/v1/races/9", body: `{"name": "Bravo"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusPreconditionFailed,
+			writes: []string{"1"},
+		},
+		{
+			// If-Match takes the place of any etag in the body.
+			name:   "PATCH with an etag in the body too",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo", "etag": "0"}`,
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusOK,
+			writes: []string{"1"},
+		},
+		{
+			name:   "PATCH without If-Match",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name": "Bravo"}`,
+			status: http.StatusOK,
+			writes: []string{""},
+		},
+		{
+			name:   "PATCH with a malformed body",
+			method: http.MethodPatch, path: "/v1/races/1", body: `{"name":`,
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "DELETE with the current etag",
+			method: http.MethodDelete, path: "/v1/races/1",
+			header: map[string]string{"If-Match": `"1"`},
+			status: http.StatusOK,
+			writes: []string{"1"},
+		},
+		{
+			name:   "DELETE with a stale etag",
+			method: http.MethodDelete, path: "/v1/races/1",
+			header: map[string]string{"If-Match": `"0"`},
+			status: http.StatusPreconditionFailed,
+			writes: []string{"0"},
+		},
+		{
+			name:   "DELETE with a list including the current etag",
+			method: http.MethodDelete, path: "/v1/races/1",
+			header: map[string]string{"If-Match": `"0", "1"`},
+			status: http.StatusOK,
+			writes: []string{"1"},
+		},
+		{
+			name:   "DELETE with the etag in the query",
+			method: http.MethodDelete, path: "/v1/races/1?etag=1",
+			status: http.StatusOK,
+			writes: []string{"1"},
+		},
+		{
+			// Without If-Match, a stale etag is a conflict like any other.
+			name:   "DELETE with a stale etag in the query",
+			method: http.MethodDelete, path: "/v1/races/1?etag=0",
+			status: http.StatusConflict,
+			writes: []string{"0"},
+		},
+		{
+			name:   "GET with the current etag",
+			method: http.MethodGet, path: "/v1/races/1",
+			header: map[string]string{"If-None-Match": `"1"`},
+			status: http.StatusNotModified,
+			etag:   `"1"`,
+		},
+		{
+			// If-None-Match compares weakly.
+			name:   "GET with the current etag, weak",
+			method: http.MethodGet, path: "/v1/races/1",
+			header: map[string]string{"If-None-Match": `W/"1"`},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "GET with a list including the current etag",
+			method: http.MethodGet, path: "/v1/races/1",
+			header: map[string]string{"If-None-Match": `"0", "1"`},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "GET with any etag",
+			method: http.MethodGet, path: "/v1/races/1",
+			header: map[string]string{"If-None-Match": `*`},
+			status: http.StatusNotModified,
+		},
+		{
+			name:   "GET with a stale etag",
+			method: http.MethodGet, path: "/v1/races/1",
+			header:   map[string]string{"If-None-Match": `"0"`},
+			status:   http.StatusOK,
+			etag:     `"1"`,
+			contains: `"name":"Alpha"`,
+		},
+		{
+			name:   "GET of a missing race",
+			method: http.MethodGet, path: "/v1/races/9",
+			header: map[string]string{"If-None-Match": `"1"`},
+			status: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			server := newETagRacingServer()
+
+			mux := runtime.NewServeMux(
+				runtime.WithForwardResponseOption(setETag),
+				runtime.WithErrorHandler(rateLimitErrorHandler),
+			)
+			if err := racing.RegisterRacingHandler(context.Background(), mux, serveRacing(t, server)); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+
+			withConditionalRequests(mux).ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.etag != "" && w.Header().Get("ETag") != tt.etag {
+				t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), tt.etag)
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with body %q, want none", w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body = %s, want it to contain %s", w.Body, tt.contains)
+			}
+
+			if fmt.Sprintf("%q", server.writes) != fmt.Sprintf("%q", tt.writes) {
+				t.Errorf("writes conditional on %q, want %q", server.writes, tt.writes)
+			}
+		})
+	}
+}
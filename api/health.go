@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthCheckTimeout bounds how long a readiness probe waits on the racing
+// service.
+const healthCheckTimeout = time.Second
+
+// probes serves the gateway's liveness and readiness endpoints, for
+// orchestrators to decide whether to restart it or route traffic to it.
+//
+// /healthz reports the gateway is alive. It fails only once the racing
+// connection has been shut down, so an unavailable racing service doesn't get
+// the gateway restarted too. /readyz asks the racing service's health check
+// whether it's serving, failing while it isn't, or can't be reached, and
+// once the gateway is shutting down.
+type probes struct {
+	conn   *grpc.ClientConn
+	health healthpb.HealthClient
+
+	// stopping is 1 once shutdown has begun.
+	stopping int32
+}
+
+// newProbes creates probes checking the racing service on conn.
+func newProbes(conn *grpc.ClientConn) *probes {
+	return &probes{conn: conn, health: healthpb.NewHealthClient(conn)}
+}
+
+// Shutdown fails readiness from now on, so load balancers stop sending us
+// requests.
+func (p *probes) Shutdown() {
+	atomic.StoreInt32(&p.stopping, 1)
+}
+
+// probeResponse is the body of a probe response.
+type probeResponse struct {
+	Status string `json:"status"`
+	Racing string `json:"racing"`
+	Error  string `json:"error,omitempty"`
+}
+
+// register adds the probe endpoints to mux.
+func (p *probes) register(mux *runtime.ServeMux) error {
+	if err := handlePath(mux, http.MethodGet, "/healthz", p.serveHealthz); err != nil {
+		return err
+	}
+
+	return handlePath(mux, http.MethodGet, "/readyz", p.serveReadyz)
+}
+
+func (p *probes) serveHealthz(w http.ResponseWriter, _ *http.Request, _ map[string]string) {
+	state := p.conn.GetState()
+	if state == connectivity.Shutdown {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: "unhealthy", Racing: state.String()})
+		return
+	}
+
+	writeProbe(w, http.StatusOK, probeResponse{Status: "ok", Racing: state.String()})
+}
+
+func (p *probes) serveReadyz(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	if atomic.LoadInt32(&p.stopping) == 1 {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: "shutting down", Racing: "unknown"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	resp, err := p.health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{
+			Status: "unready",
+			Racing: status.Code(err).String(),
+			Error:  err.Error(),
+		})
+		return
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		writeProbe(w, http.StatusServiceUnavailable, probeResponse{Status: "unready", Racing: resp.Status.String()})
+		return
+	}
+
+	writeProbe(w, http.StatusOK, probeResponse{Status: "ok", Racing: resp.Status.String()})
+}
+
+// writeProbe writes a probe response. Probes are never cached, as their
+// answer changes without notice.
+func writeProbe(w http.ResponseWriter, code int, resp probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// notProbe reports whether r isn't a probe, so probes can be left out of
+// traces.
+func notProbe(r *http.Request) bool {
+	return r.URL.Path != "/healthz" && r.URL.Path != "/readyz"
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksReloadInterval is the least time between checks of whether the
+	// JWKS file has changed.
+	jwksReloadInterval = time.Second
+
+	// jwtLeeway is how far clocks may drift before a token is considered
+	// expired, or not yet valid.
+	jwtLeeway = 30 * time.Second
+
+	// minRSAKeyBits is the smallest RSA key we accept signatures from.
+	minRSAKeyBits = 2048
+)
+
+// jwtVerifier authenticates callers by JWTs, sent as bearer tokens in the
+// Authorization header, and verified with golang-jwt. Tokens must be signed
+// with RS256 or ES256 by a key in a local JWKS file, which is reloaded once it
+// changes so keys can be rotated, and be unexpired. Scopes are read from the
+// scope claim, as a space separated string, or the scp claim, as an array.
+type jwtVerifier struct {
+	path     string
+	issuer   string
+	audience string
+	now      func() time.Time
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	keys    map[string]crypto.PublicKey
+}
+
+// newJWTVerifier verifies tokens against the JWKS file at path. When issuer
+// or audience are set, tokens must have been issued by and for them.
+func newJWTVerifier(path, issuer, audience string, now func() time.Time) (*jwtVerifier, error) {
+	v := &jwtVerifier{path: path, issuer: issuer, audience: audience, now: now}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.keys, err = readJWKS(path); err != nil {
+		return nil, err
+	}
+	v.modTime, v.checked = info.ModTime(), now()
+
+	return v, nil
+}
+
+// jwtClaims are the claims of a token we check or use.
+type jwtClaims struct {
+	jwt.RegisteredClaims
+	Scope string   `json:"scope"`
+	Scp   []string `json:"scp"`
+}
+
+func (v *jwtVerifier) authenticate(r *http.Request) (*identity, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, errNoCredentials
+	}
+
+	claims, err := v.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bearer token: %w", err)
+	}
+
+	scopes := strings.Fields(claims.Scope)
+	if len(scopes) == 0 {
+		scopes = claims.Scp
+	}
+
+	return &identity{subject: claims.Subject, scopes: scopes, method: "jwt"}, nil
+}
+
+// verify checks token's signature and claims, returning its claims. The
+// algorithm must match the type of key, so a token can't pick a weaker one,
+// which the signing methods check as they verify.
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(jwtLeeway),
+		jwt.WithTimeFunc(v.now),
+	}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	var claims jwtClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, v.keyFunc, opts...); err != nil {
+		return nil, err
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("no subject")
+	}
+
+	return &claims, nil
+}
+
+// keyFunc returns the key a token must be signed by, named by its kid
+// header.
+func (v *jwtVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	return v.key(kid)
+}
+
+// key returns the verification key with ID kid. A token without a key ID can
+// only be verified when the JWKS holds a single key.
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	keys := v.load()
+
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// load returns the keys in the JWKS file, rereading it if it has changed. A
+// failed reload is logged, and the keys loaded last kept in use.
+func (v *jwtVerifier) load() map[string]crypto.PublicKey {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.now().Sub(v.checked) < jwksReloadInterval {
+		return v.keys
+	}
+	v.checked = v.now()
+
+	info, err := os.Stat(v.path)
+	if err != nil {
+		log.Errorf("failed checking JWKS: %s", err)
+		return v.keys
+	}
+
+	if info.ModTime().Equal(v.modTime) {
+		return v.keys
+	}
+
+	keys, err := readJWKS(v.path)
+	if err != nil {
+		log.Errorf("failed reloading JWKS: %s", err)
+		return v.keys
+	}
+
+	log.Infof("reloaded JWKS %s", v.path)
+	v.keys, v.modTime = keys, info.ModTime()
+
+	return v.keys
+}
+
+// jwk is a JSON Web Key, with the parameters of the RSA and EC keys we
+// support.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// readJWKS reads the signing keys in the JWKS file at path, by key ID.
+func readJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed parsing JWKS %s: %w", path, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q in %s: %w", k.Kid, path, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys in %s", path)
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent too large")
+		}
+
+		if n.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeInt decodes a base64url encoded big-endian integer.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("malformed key")
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
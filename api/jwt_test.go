@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtTestKeys are the keys tokens are signed with in tests.
+type jwtTestKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jwtTestKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// toJWK returns the public half of key as a JWK with ID kid.
+func toJWK(kid string, key interface{}) jwk {
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encode(key.N), E: encode(big.NewInt(int64(key.E)))}
+	case *ecdsa.PrivateKey:
+		return jwk{Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256", X: encode(key.X), Y: encode(key.Y)}
+	}
+
+	panic("unsupported key")
+}
+
+// writeJWKS writes the public halves of keys, by key ID, to the JWKS file at
+// path, dated modTime so reloads notice it changed.
+func writeJWKS(t *testing.T, path string, modTime time.Time, keys map[string]interface{}) {
+	t.Helper()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, toJWK(kid, key))
+	}
+
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns a token with claims, signed by key with method, naming kid as
+// its key when set.
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	now := time.Now()
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, now, map[string]interface{}{"rsa": keys.rsa, "ec": keys.ec})
+
+	verifier, err := newJWTVerifier(path, "https://issuer.example", "racing-api", func() time.Time { return now })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// claims returns valid claims, with changes applied.
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":   "tester",
+			"iss":   "https://issuer.example",
+			"aud":   "racing-api",
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "races:read races:write",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+
+		return c
+	}
+
+	valid := sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(nil))
+	parts := strings.Split(valid, ".")
+
+	noneToken, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An HS256 token keyed with the RSA public key, as an attacker who knows
+	// it could make if the algorithm weren't tied to the key.
+	publicKeyBytes := keys.rsa.PublicKey.N.Bytes()
+
+	tests := []struct {
+		name   string
+		token  string
+		scopes []string
+		err    bool
+	}{
+		{
+			name:   "RS256",
+			token:  valid,
+			scopes: []string{"races:read", "races:write"},
+		},
+		{
+			name:   "ES256",
+			token:  sign(t, jwt.SigningMethodES256, "ec", keys.ec, claims(nil)),
+			scopes: []string{"races:read", "races:write"},
+		},
+		{
+			name:   "scp claim",
+			token:  sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"scope": nil, "scp": []string{"races:read"}})),
+			scopes: []string{"races:read"},
+		},
+		{
+			name:   "audience among several",
+			token:  sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"aud": []string{"other", "racing-api"}})),
+			scopes: []string{"races:read", "races:write"},
+		},
+		{
+			name:   "expired within leeway",
+			token:  sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"exp": now.Add(-jwtLeeway / 2).Unix()})),
+			scopes: []string{"races:read", "races:write"},
+		},
+		{
+			name:  "alg none",
+			token: noneToken,
+			err:   true,
+		},
+		{
+			name:  "alg none naming a key",
+			token: sign(t, jwt.SigningMethodNone, "rsa", jwt.UnsafeAllowNoneSignatureType, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "HS256 keyed with the RSA public key",
+			token: sign(t, jwt.SigningMethodHS256, "rsa", publicKeyBytes, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "RS256 naming an EC key",
+			token: sign(t, jwt.SigningMethodRS256, "ec", keys.rsa, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "ES256 naming an RSA key",
+			token: sign(t, jwt.SigningMethodES256, "rsa", keys.ec, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "expired",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})),
+			err:   true,
+		},
+		{
+			name:  "no expiry",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"exp": nil})),
+			err:   true,
+		},
+		{
+			name:  "not valid yet",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})),
+			err:   true,
+		},
+		{
+			name:  "wrong issuer",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"iss": "https://other.example"})),
+			err:   true,
+		},
+		{
+			name:  "wrong audience",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"aud": "other"})),
+			err:   true,
+		},
+		{
+			name:  "no audience",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"aud": nil})),
+			err:   true,
+		},
+		{
+			name:  "no subject",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", keys.rsa, claims(jwt.MapClaims{"sub": nil})),
+			err:   true,
+		},
+		{
+			name:  "unknown key",
+			token: sign(t, jwt.SigningMethodRS256, "other", keys.rsa, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "no key ID with several keys",
+			token: sign(t, jwt.SigningMethodRS256, "", keys.rsa, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "signed by another key",
+			token: sign(t, jwt.SigningMethodRS256, "rsa", newJWTTestKeys(t).rsa, claims(nil)),
+			err:   true,
+		},
+		{
+			name:  "malformed signature",
+			token: parts[0] + "." + parts[1] + ".not*base64",
+			err:   true,
+		},
+		{
+			name:  "truncated signature",
+			token: parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])/2],
+			err:   true,
+		},
+		{
+			name:  "claims changed after signing",
+			token: parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":9999999999}`)) + "." + parts[2],
+			err:   true,
+		},
+		{
+			name:  "not a JWT",
+			token: "not-a-jwt",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/list-races", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+
+			id, err := verifier.authenticate(r)
+			if tt.err {
+				if err == nil {
+					t.Fatal("authenticated, want the token refused")
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate: %s", err)
+			}
+
+			if id.subject != "tester" || id.method != "jwt" || strings.Join(id.scopes, " ") != strings.Join(tt.scopes, " ") {
+				t.Errorf("identity = %+v, want subject tester with scopes %v", id, tt.scopes)
+			}
+		})
+	}
+}
+
+func TestJWTVerifierRotation(t *testing.T) {
+	oldKey, newKey := newJWTTestKeys(t).rsa, newJWTTestKeys(t).rsa
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, now, map[string]interface{}{"old": oldKey})
+
+	verifier, err := newJWTVerifier(path, "", "", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := jwt.MapClaims{"sub": "tester", "exp": now.Add(time.Hour).Unix()}
+	oldToken := sign(t, jwt.SigningMethodRS256, "old", oldKey, claims)
+	newToken := sign(t, jwt.SigningMethodRS256, "new", newKey, claims)
+
+	if _, err := verifier.verify(oldToken); err != nil {
+		t.Fatalf("verify token of the old key: %s", err)
+	}
+	if _, err := verifier.verify(newToken); err == nil {
+		t.Fatal("verified a token of the new key before it was published")
+	}
+
+	// Publish the new key alongside the old, so tokens of either verify.
+	writeJWKS(t, path, now.Add(time.Second), map[string]interface{}{"old": oldKey, "new": newKey})
+
+	if _, err := verifier.verify(newToken); err == nil {
+		t.Fatal("verified a token of the new key before checking for it")
+	}
+
+	now = now.Add(jwksReloadInterval)
+
+	if _, err := verifier.verify(newToken); err != nil {
+		t.Fatalf("verify token of the new key once published: %s", err)
+	}
+	if _, err := verifier.verify(oldToken); err != nil {
+		t.Fatalf("verify token of the old key while still published: %s", err)
+	}
+
+	// Retire the old key.
+	writeJWKS(t, path, now.Add(time.Second), map[string]interface{}{"new": newKey})
+	now = now.Add(jwksReloadInterval)
+
+	if _, err := verifier.verify(oldToken); err == nil {
+		t.Error("verified a token of the retired key")
+	}
+	if _, err := verifier.verify(newToken); err != nil {
+		t.Errorf("verify token of the new key: %s", err)
+	}
+
+	// A broken JWKS leaves the keys loaded last in use.
+	if err := ioutil.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, now.Add(time.Second), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(jwksReloadInterval)
+
+	if _, err := verifier.verify(newToken); err != nil {
+		t.Errorf("verify token of the new key with a broken JWKS: %s", err)
+	}
+}
@@ -2,44 +2,294 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/api/proto/sports"
+	"git.neds.sh/matty/entain/internal/platform/metrics"
+	"git.neds.sh/matty/entain/internal/platform/tlsreload"
+	"git.neds.sh/matty/entain/internal/platform/tracing"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
-	apiEndpoint  = flag.String("api-endpoint", "localhost:8000", "API endpoint")
-	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+	apiEndpoint        = flag.String("api-endpoint", "localhost:8000", "API endpoint")
+	racingGRPCEndpoint = flag.String("racing-grpc-endpoint", "localhost:9000", "Racing gRPC server endpoint")
+	sportsGRPCEndpoint = flag.String("sports-grpc-endpoint", "localhost:9001", "Sports gRPC server endpoint")
+	streamHeartbeat    = flag.Duration("stream-heartbeat", 15*time.Second, "Interval between heartbeats on idle race event streams")
+	metricsEndpoint    = flag.String("metrics-endpoint", "localhost:8100", "HTTP endpoint serving Prometheus metrics at /metrics")
+	traceExporter      = flag.String("trace-exporter", "none", "Where spans are exported: none, stdout, or otlp")
+	otlpEndpoint       = flag.String("otlp-endpoint", "", "OTLP gRPC collector endpoint (OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317 when empty)")
+	otlpInsecure       = flag.Bool("otlp-insecure", false, "Export spans to the OTLP collector without TLS")
+	tlsCert            = flag.String("tls-cert", "", "PEM certificate to serve HTTPS with, reloaded when it changes")
+	tlsKey             = flag.String("tls-key", "", "PEM private key of --tls-cert")
+	racingTLSCA        = flag.String("racing-tls-ca", "", "PEM CA bundle to verify the racing service with, connecting over TLS when set")
+	racingTLSCert      = flag.String("racing-tls-cert", "", "PEM client certificate to present to the racing service (mutual TLS)")
+	racingTLSKey       = flag.String("racing-tls-key", "", "PEM private key of --racing-tls-cert")
+	racingTLSName      = flag.String("racing-tls-server-name", "", "Name the racing service's certificate is verified against (the host of --racing-grpc-endpoint when empty)")
+	authAPIKeys        = flag.String("auth-api-keys", "", "YAML or JSON file of API keys callers may authenticate with, sent in X-API-Key")
+	authJWKS           = flag.String("auth-jwks", "", "JWKS file of keys which callers' bearer tokens must be signed by, reloaded when it changes")
+	authJWTIssuer      = flag.String("auth-jwt-issuer", "", "Issuer bearer tokens must have (any when empty)")
+	authJWTAudience    = flag.String("auth-jwt-audience", "", "Audience bearer tokens must be issued for (any when empty)")
+	rateLimitsPath     = flag.String("rate-limits", "", "YAML or JSON file of how often each client may call each route (unlimited when empty)")
+	shutdownDelay      = flag.Duration("shutdown-delay", 0, "How long to fail /readyz on SIGINT or SIGTERM before draining, for load balancers to notice")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 15*time.Second, "How long in-flight requests are given to finish on shutdown before they're cut off")
+	readHeaderTimeout  = flag.Duration("read-header-timeout", 10*time.Second, "How long clients are given to send a request's headers (unlimited when 0)")
+	readTimeout        = flag.Duration("read-timeout", 30*time.Second, "How long clients are given to send a whole request, body included (unlimited when 0)")
+	writeTimeout       = flag.Duration("write-timeout", 30*time.Second, "How long a response may take to write, from the end of its request's headers; race event streams are exempt (unlimited when 0)")
+	idleTimeout        = flag.Duration("idle-timeout", 2*time.Minute, "How long idle keep-alive connections are kept open (--read-timeout when 0)")
 )
 
 func main() {
 	flag.Parse()
 
+	if err := loadConfig(); err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
 	if err := run(); err != nil {
 		log.Fatalf("failed running api server: %s", err)
 	}
 }
 
 func run() error {
+	logConfig()
+
+	// ctx outlives shutdown, as the backend connections made with it must
+	// stay open while in-flight requests finish.
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	mux := runtime.NewServeMux()
+	// stopping is done once we're asked to stop.
+	stopping, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, "api", tracing.Config{
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *otlpEndpoint,
+		OTLPInsecure: *otlpInsecure,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("failed flushing spans: %s", err)
+		}
+	}()
+
+	// Calls to the backends carry the trace context of the request they
+	// serve, so their spans join its trace.
+	// Calls also carry the identity of the caller they're made for, and are
+	// refused once the caller exceeds its rate limit.
+	dialOpts := []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(), unaryIdentity, unaryRateLimit),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(), streamIdentity, streamRateLimit),
+	}
+
+	authenticators, err := loadAuthenticators()
+	if err != nil {
+		return err
+	}
+
+	var limits *rateLimits
+	if *rateLimitsPath != "" {
+		if limits, err = loadRateLimits(*rateLimitsPath, time.Now); err != nil {
+			return err
+		}
+	}
+
+	racingCreds, err := racingCredentials()
+	if err != nil {
+		return err
+	}
+
+	racingDialOpts := append([]grpc.DialOption{racingCreds}, dialOpts...)
+	sportsDialOpts := append([]grpc.DialOption{grpc.WithInsecure()}, dialOpts...)
+
+	mux := runtime.NewServeMux(
+		runtime.WithForwardResponseOption(setETag),
+		runtime.WithErrorHandler(rateLimitErrorHandler),
+		runtime.WithMetadata(recordRoute),
+	)
 	if err := racing.RegisterRacingHandlerFromEndpoint(
 		ctx,
 		mux,
-		*grpcEndpoint,
-		[]grpc.DialOption{grpc.WithInsecure()},
+		*racingGRPCEndpoint,
+		racingDialOpts,
 	); err != nil {
 		return err
 	}
 
+	racingConn, err := grpc.DialContext(ctx, *racingGRPCEndpoint, racingDialOpts...)
+	if err != nil {
+		return err
+	}
+	defer racingConn.Close()
+
+	events := newRaceEvents(racing.NewRacingClient(racingConn), *streamHeartbeat)
+	if err := events.register(mux); err != nil {
+		return err
+	}
+
+	probes := newProbes(racingConn)
+	if err := probes.register(mux); err != nil {
+		return err
+	}
+
+	if err := sports.RegisterSportsHandlerFromEndpoint(
+		ctx,
+		mux,
+		*sportsGRPCEndpoint,
+		sportsDialOpts,
+	); err != nil {
+		return err
+	}
+
+	metricsConn, err := net.Listen("tcp", *metricsEndpoint)
+	if err != nil {
+		return fmt.Errorf("failed listening for metrics: %w", err)
+	}
+
+	metricsServer := metrics.Serve(metricsConn)
+	defer metricsServer.Close()
+
 	log.Infof("API server listening on: %s", *apiEndpoint)
 
-	return http.ListenAndServe(*apiEndpoint, mux)
+	handler := withMetrics(withAuth(authenticators, withRateLimits(limits, withConditionalRequests(mux))))
+
+	server := &http.Server{
+		Addr:              *apiEndpoint,
+		Handler:           withoutStreamTimeouts(otelhttp.NewHandler(handler, "api", otelhttp.WithFilter(notProbe))),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	server.RegisterOnShutdown(events.Shutdown)
+
+	if *tlsCert != "" {
+		if server.TLSConfig, err = serverTLSConfig(*tlsCert, *tlsKey); err != nil {
+			return err
+		}
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			served <- server.ListenAndServeTLS("", "")
+		} else {
+			served <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-stopping.Done():
+	}
+
+	log.Info("shutting down")
+
+	return drain(probes, server, metricsServer, *shutdownDelay, *shutdownTimeout)
+}
+
+// drain stops serving once we've been asked to stop. Readiness fails first,
+// so load balancers stop sending us new requests before we stop accepting
+// them, then in-flight requests are given until timeout to finish. Metrics
+// are served until the end, so the drain itself can be watched.
+func drain(probes *probes, server, metricsServer *http.Server, delay, timeout time.Duration) error {
+	probes.Shutdown()
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Warnf("in-flight requests still running after %s, stopping anyway", timeout)
+		err = server.Close()
+	}
+
+	metrics.Shutdown(metricsServer, timeout)
+
+	return err
+}
+
+// racingCredentials returns the credentials to dial the racing service with,
+// over TLS when --racing-tls-ca is set.
+func racingCredentials() (grpc.DialOption, error) {
+	if *racingTLSCA == "" {
+		return grpc.WithInsecure(), nil
+	}
+
+	files, err := tlsreload.Load(*racingTLSCert, *racingTLSKey, *racingTLSCA)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := *racingTLSName
+	if serverName == "" {
+		serverName, _, err = net.SplitHostPort(*racingGRPCEndpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsreload.ClientConfig(files, serverName))), nil
+}
+
+// serverTLSConfig serves HTTPS with the given certificate, over HTTP/2 or
+// HTTP/1.1.
+func serverTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	files, err := tlsreload.Load(certFile, keyFile, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsreload.ServerConfig(files, "h2", "http/1.1"), nil
+}
+
+// loadAuthenticators returns the authenticators configured for callers. With
+// none, callers aren't authenticated.
+func loadAuthenticators() ([]authenticator, error) {
+	var authenticators []authenticator
+
+	if *authAPIKeys != "" {
+		keys, err := loadAPIKeys(*authAPIKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, keys)
+	}
+
+	if *authJWKS != "" {
+		verifier, err := newJWTVerifier(*authJWKS, *authJWTIssuer, *authJWTAudience, time.Now)
+		if err != nil {
+			return nil, err
+		}
+
+		authenticators = append(authenticators, verifier)
+	}
+
+	if len(authenticators) == 0 {
+		log.Warn("no --auth-api-keys or --auth-jwks set, callers won't be authenticated")
+	}
+
+	return authenticators, nil
 }
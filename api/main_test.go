@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/metrics"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+)
+
+// drainTest is a gateway, with metrics, with a request in flight.
+type drainTest struct {
+	probes  *probes
+	server  *http.Server
+	metrics *http.Server
+	url     string
+	scrapes string
+
+	release chan struct{}
+
+	// inFlight receives the result of the request in flight.
+	inFlight chan error
+}
+
+// drainClient makes a connection per request, so that none are left idle
+// for the drain to close.
+var drainClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+func newDrainTest(t *testing.T) *drainTest {
+	t.Helper()
+
+	// Readiness isn't checked against the racing service once draining.
+	conn, err := grpc.Dial("127.0.0.1:1", grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	d := &drainTest{
+		probes:   newProbes(conn),
+		release:  make(chan struct{}),
+		inFlight: make(chan error, 1),
+	}
+
+	entered := make(chan struct{})
+	mux := runtime.NewServeMux()
+	if err := d.probes.register(mux); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlePath(mux, http.MethodGet, "/v1/slow", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		close(entered)
+		<-d.release
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.server = &http.Server{Handler: mux}
+	go d.server.Serve(ln)
+	t.Cleanup(func() { d.server.Close() })
+	d.url = "http://" + ln.Addr().String()
+
+	metricsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.metrics = metrics.Serve(metricsLn)
+	t.Cleanup(func() { d.metrics.Close() })
+	d.scrapes = "http://" + metricsLn.Addr().String() + "/metrics"
+
+	go func() {
+		resp, err := drainClient.Get(d.url + "/v1/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		d.inFlight <- err
+	}()
+	<-entered
+
+	return d
+}
+
+// get returns the status of a GET of url, or 0 if it couldn't be made.
+func (d *drainTest) get(url string) int {
+	resp, err := drainClient.Get(url)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestDrain(t *testing.T) {
+	d := newDrainTest(t)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- drain(d.probes, d.server, d.metrics, 200*time.Millisecond, 5*time.Second)
+	}()
+
+	// Readiness fails first, while requests are still accepted.
+	for deadline := time.Now().Add(time.Second); ; {
+		code := d.get(d.url + "/readyz")
+		if code == http.StatusServiceUnavailable {
+			break
+		}
+		if code != http.StatusOK || time.Now().After(deadline) {
+			t.Fatalf("readyz = %d while draining, want %d", code, http.StatusServiceUnavailable)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The in-flight request is waited for, and metrics served meanwhile.
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-drained:
+		t.Fatalf("drained (%v) with a request in flight", err)
+	default:
+	}
+	if code := d.get(d.scrapes); code != http.StatusOK {
+		t.Errorf("metrics = %d while draining, want %d", code, http.StatusOK)
+	}
+
+	close(d.release)
+	if err := <-d.inFlight; err != nil {
+		t.Errorf("in-flight request: %s, want it to finish", err)
+	}
+
+	if err := <-drained; err != nil {
+		t.Errorf("drain: %s", err)
+	}
+	if code := d.get(d.scrapes); code != 0 {
+		t.Errorf("metrics = %d once drained, want them stopped", code)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	d := newDrainTest(t)
+	defer close(d.release)
+
+	start := time.Now()
+	if err := drain(d.probes, d.server, d.metrics, 0, 50*time.Millisecond); err != nil {
+		t.Errorf("drain: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drained after %s, want the in-flight request cut off", elapsed)
+	}
+
+	// The request is cut off rather than left to finish.
+	if err := <-d.inFlight; err == nil {
+		t.Error("in-flight request finished, want it cut off")
+	}
+
+	if code := d.get(d.scrapes); code != 0 {
+		t.Errorf("metrics = %d once drained, want them stopped", code)
+	}
+}
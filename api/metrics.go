@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// unmatchedRoute labels requests which didn't match any route, so that
+// arbitrary paths can't inflate the number of series.
+const unmatchedRoute = "unmatched"
+
+var (
+	// httpRequests counts completed requests, by route and status code.
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_http_requests_total",
+		Help: "Completed HTTP requests, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// httpDuration times requests. For race event streams this is how long
+	// the client stayed connected.
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "api_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+// routeKey is the context key holding where the matched route is recorded.
+type routeKey struct{}
+
+// withMetrics records the count, status and latency of requests, labelled
+// by the route pattern they matched rather than their path.
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Filled in by recordRoute or handlePath once the mux has routed
+		// the request.
+		route := new(string)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey{}, route)))
+
+		if *route == "" {
+			*route = unmatchedRoute
+		}
+
+		// Spans are named by route too, rather than after every distinct path.
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + *route)
+		span.SetAttributes(semconv.HTTPRouteKey.String(*route))
+
+		httpRequests.WithLabelValues(*route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(*route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// recordRoute is a gateway metadata annotator, which records the route
+// pattern of each request it proxies for withMetrics. It adds no metadata.
+func recordRoute(ctx context.Context, r *http.Request) metadata.MD {
+	if pattern, ok := runtime.HTTPPathPattern(ctx); ok {
+		setRoute(r, pattern)
+	}
+
+	return nil
+}
+
+// handlePath registers h with mux like HandlePath does, recording pattern as
+// the route of the requests it serves.
+func handlePath(mux *runtime.ServeMux, method, pattern string, h runtime.HandlerFunc) error {
+	return mux.HandlePath(method, pattern, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+		setRoute(r, pattern)
+		h(w, r, pathParams)
+	})
+}
+
+// setRoute records the route a request matched, if withMetrics is
+// listening for it.
+func setRoute(r *http.Request, pattern string) {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*route = pattern
+	}
+}
+
+// statusRecorder captures the status code a response is written with. It
+// passes flushes and hijacks through, so event streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+
+	// Hijacking is only done to upgrade to a WebSocket.
+	w.status = http.StatusSwitchingProtocols
+	w.wroteHeader = true
+
+	return hijacker.Hijack()
+}
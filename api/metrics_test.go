@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMetricsRoutes(t *testing.T) {
+	mux := runtime.NewServeMux(
+		runtime.WithErrorHandler(rateLimitErrorHandler),
+		runtime.WithMetadata(recordRoute),
+	)
+	if err := racing.RegisterRacingHandler(context.Background(), mux, serveRacing(t, newETagRacingServer())); err != nil {
+		t.Fatal(err)
+	}
+	if err := handlePath(mux, http.MethodGet, "/v1/test-routes/{name}", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		// Nothing is written, which is an implicit 200.
+	}); err != nil {
+		t.Fatal(err)
+	}
+	handler := withMetrics(mux)
+
+	tests := []struct {
+		name   string
+		method string
+		paths  []string
+
+		route string
+		code  string
+	}{
+		{
+			// Races are counted together, however many there are.
+			name:   "proxied route",
+			method: http.MethodGet,
+			paths:  []string{"/v1/races/1", "/v1/races/1?etag=1"},
+			route:  "/v1/races/{id}",
+			code:   "200",
+		},
+		{
+			name:   "proxied route error",
+			method: http.MethodGet,
+			paths:  []string{"/v1/races/9", "/v1/races/10"},
+			route:  "/v1/races/{id}",
+			code:   "404",
+		},
+		{
+			name:   "handled path",
+			method: http.MethodGet,
+			paths:  []string{"/v1/test-routes/a", "/v1/test-routes/b"},
+			route:  "/v1/test-routes/{name}",
+			code:   "200",
+		},
+		{
+			// Arbitrary paths can't add series.
+			name:   "unmatched",
+			method: http.MethodGet,
+			paths:  []string{"/v1/nope", "/wp-admin/login.php"},
+			route:  unmatchedRoute,
+			code:   "404",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			requests := httpRequests.WithLabelValues(tt.route, tt.method, tt.code)
+			before := testutil.ToFloat64(requests)
+
+			for _, path := range tt.paths {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(tt.method, path, nil))
+
+				if code := strconv.Itoa(w.Code); code != tt.code {
+					t.Errorf("%s %s = %s, want %s", tt.method, path, code, tt.code)
+				}
+			}
+
+			if got := testutil.ToFloat64(requests) - before; got != float64(len(tt.paths)) {
+				t.Errorf("%d requests counted as route %q code %s, want %d", int(got), tt.route, tt.code, len(tt.paths))
+			}
+		})
+	}
+}
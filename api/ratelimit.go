@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/ratelimit"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"gopkg.in/yaml.v3"
+)
+
+// rateLimitsFile is the YAML or JSON file rate limits are read from. Routes
+// are keyed by method and pattern, as they're labelled in metrics, e.g.
+// "POST /v1/list-races".
+type rateLimitsFile struct {
+	Default *ratelimit.Limit           `yaml:"default"`
+	Routes  map[string]ratelimit.Limit `yaml:"routes"`
+}
+
+// rateLimits limits how often each client may call each route, with a token
+// bucket per client for every route with its own limit, and one shared by
+// the rest. Clients are told where they stand in the RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy headers.
+type rateLimits struct {
+	def     *ratelimit.Limit
+	routes  map[string]ratelimit.Limit
+	limiter *ratelimit.Limiter
+}
+
+// loadRateLimits reads rate limits from the file at path.
+func loadRateLimits(path string, now func() time.Time) (*rateLimits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rateLimitsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed parsing rate limits %s: %w", path, err)
+	}
+
+	if file.Default != nil {
+		if err := file.Default.Validate(); err != nil {
+			return nil, fmt.Errorf("default rate limit in %s: %w", path, err)
+		}
+	}
+
+	for route, limit := range file.Routes {
+		method, pattern := splitRoute(route)
+		if method == "" || !strings.HasPrefix(pattern, "/") {
+			return nil, fmt.Errorf("rate limited route %q in %s must be a method and pattern, e.g. \"POST /v1/list-races\"", route, path)
+		}
+
+		if err := limit.Validate(); err != nil {
+			return nil, fmt.Errorf("rate limit of %s in %s: %w", route, path, err)
+		}
+	}
+
+	return &rateLimits{def: file.Default, routes: file.Routes, limiter: ratelimit.New(now)}, nil
+}
+
+// splitRoute splits a route into its method and pattern.
+func splitRoute(route string) (string, string) {
+	fields := strings.Fields(route)
+	if len(fields) != 2 {
+		return "", ""
+	}
+
+	return strings.ToUpper(fields[0]), fields[1]
+}
+
+// rateLimitKey is the context key holding the rate limited request a call to
+// a backend is made for.
+type rateLimitKey struct{}
+
+// rateLimitedRequest is a request which is rate limited as it calls the
+// backends.
+type rateLimitedRequest struct {
+	limits *rateLimits
+	method string
+	client string
+
+	// header is the response's, which the limit is reported in.
+	header http.Header
+}
+
+// withRateLimits rate limits requests by the authenticated caller, or the
+// client's IP when there isn't one. As the route a request matched is only
+// known once the mux has routed it, the limit is applied by the unaryRateLimit
+// and streamRateLimit interceptors as it calls a backend. Probes aren't
+// limited, as they don't call one.
+func withRateLimits(limits *rateLimits, next http.Handler) http.Handler {
+	if limits == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &rateLimitedRequest{limits: limits, method: r.Method, client: rateLimitClient(r), header: w.Header()}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitKey{}, req)))
+	})
+}
+
+// rateLimitClient returns who r is rate limited as. Forwarded headers are
+// ignored, as clients could set them to anything.
+func rateLimitClient(r *http.Request) string {
+	if result, ok := r.Context().Value(authKey{}).(*authResult); ok && result.id != nil {
+		return result.id.method + ":" + result.id.subject
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// unaryRateLimit fails unary calls to a backend with ResourceExhausted once
+// the client has used up its limit.
+func unaryRateLimit(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := takeRateLimit(ctx, method); err != nil {
+		return err
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamRateLimit rate limits opening streams, like unaryRateLimit.
+func streamRateLimit(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if err := takeRateLimit(ctx, method); err != nil {
+		return nil, err
+	}
+
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// takeRateLimit takes a token for the request a call to method is made for,
+// reporting the client's limit on its response. Health checks are made by the
+// gateway itself, so go unlimited.
+func takeRateLimit(ctx context.Context, method string) error {
+	req, ok := ctx.Value(rateLimitKey{}).(*rateLimitedRequest)
+	if !ok || strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	// Filled in by recordRoute or handlePath as the mux routed the request.
+	var route string
+	if r, ok := ctx.Value(routeKey{}).(*string); ok {
+		route = req.method + " " + *r
+	}
+
+	limit, ok := req.limits.routes[route]
+	if !ok {
+		if req.limits.def == nil {
+			return nil
+		}
+
+		// Routes without their own limit share the default bucket.
+		limit, route = *req.limits.def, ""
+	}
+
+	quota := req.limits.limiter.Take(req.client+" "+route, limit)
+
+	req.header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	req.header.Set("RateLimit-Remaining", strconv.Itoa(quota.Remaining))
+	req.header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(quota.Reset)))
+	req.header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, ceilSeconds(limit.Window())))
+
+	if !quota.Allowed {
+		return ratelimit.Error(quota.RetryAfter)
+	}
+
+	return nil
+}
+
+// rateLimitErrorHandler tells callers refused for exceeding a rate limit,
+// here or in a backend, when to retry, before handling the error as usual.
+func rateLimitErrorHandler(ctx context.Context, mux *runtime.ServeMux, m runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	setRetryAfter(w.Header(), err)
+
+	authErrorHandler(ctx, mux, m, w, r, err)
+}
+
+// setRetryAfter sets the Retry-After header from the retry delay of err, if
+// it's ResourceExhausted and has one.
+func setRetryAfter(header http.Header, err error) {
+	if retryAfter, ok := ratelimit.RetryAfter(err); ok {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	}
+}
+
+// ceilSeconds returns d in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"git.neds.sh/matty/entain/internal/platform/ratelimit"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+)
+
+// limitedRacingServer answers the calls the rate limit tests make, refusing
+// GetMeeting as the racing service does once its own limit is exceeded.
+type limitedRacingServer struct {
+	racing.UnimplementedRacingServer
+}
+
+func (limitedRacingServer) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
+	return &racing.ListRacesResponse{}, nil
+}
+
+func (limitedRacingServer) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	return &racing.Race{Id: in.Id}, nil
+}
+
+func (limitedRacingServer) GetMeeting(ctx context.Context, in *racing.GetMeetingRequest) (*racing.Meeting, error) {
+	return nil, ratelimit.Error(2500 * time.Millisecond)
+}
+
+// fakeClock is a clock which only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// serveRacing serves srv over gRPC until the test ends, returning a
+// connection to it dialled with opts.
+func serveRacing(t *testing.T, srv racing.RacingServer, opts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	racing.RegisterRacingServer(server, srv)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(ln.Addr().String(), append([]grpc.DialOption{grpc.WithInsecure()}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// newRateLimitedGateway serves the gateway's racing routes, limited by the
+// given rate limits file, in front of limitedRacingServer.
+func newRateLimitedGateway(t *testing.T, limitsFile string, now func() time.Time) http.Handler {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "rate-limits.yaml")
+	if err := ioutil.WriteFile(path, []byte(limitsFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	limits, err := loadRateLimits(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := serveRacing(t, limitedRacingServer{}, grpc.WithChainUnaryInterceptor(unaryRateLimit))
+
+	mux := runtime.NewServeMux(
+		runtime.WithErrorHandler(rateLimitErrorHandler),
+		runtime.WithMetadata(recordRoute),
+	)
+	if err := racing.RegisterRacingHandler(context.Background(), mux, conn); err != nil {
+		t.Fatal(err)
+	}
+
+	return withMetrics(withRateLimits(limits, mux))
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+	gateway := newRateLimitedGateway(t, `
+default:
+  rate: 0.5
+  burst: 3
+routes:
+  POST /v1/list-races:
+    rate: 1
+    burst: 2
+`, clock.Now)
+
+	type step struct {
+		// advance moves the clock on before the request.
+		advance time.Duration
+
+		method, path string
+		remoteAddr   string
+
+		status int
+
+		// headers are those checked, with "" for ones which must be
+		// missing. Retry-After must be missing unless listed.
+		headers map[string]string
+	}
+
+	steps := []step{
+		{
+			method: http.MethodPost, path: "/v1/list-races",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Limit":     "2",
+				"RateLimit-Remaining": "1",
+				"RateLimit-Reset":     "1",
+				"RateLimit-Policy":    "2;w=2",
+			},
+		},
+		{
+			method: http.MethodPost, path: "/v1/list-races",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Limit":     "2",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+				"RateLimit-Policy":    "2;w=2",
+			},
+		},
+		{
+			method: http.MethodPost, path: "/v1/list-races",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Limit":     "2",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+				"RateLimit-Policy":    "2;w=2",
+				"Retry-After":         "1",
+			},
+		},
+		{
+			// Part of a token has refilled, and the rest is rounded up.
+			advance: 600 * time.Millisecond,
+			method:  http.MethodPost, path: "/v1/list-races",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+				"Retry-After":         "1",
+			},
+		},
+		{
+			advance: 400 * time.Millisecond,
+			method:  http.MethodPost, path: "/v1/list-races",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "2",
+			},
+		},
+		{
+			// Other clients have buckets of their own.
+			method: http.MethodPost, path: "/v1/list-races",
+			remoteAddr: "192.0.2.2:1234",
+			status:     http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Remaining": "1",
+			},
+		},
+		{
+			// Routes without their own limit share the default.
+			method: http.MethodGet, path: "/v1/races/1",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Limit":     "3",
+				"RateLimit-Remaining": "2",
+				"RateLimit-Reset":     "2",
+				"RateLimit-Policy":    "3;w=6",
+			},
+		},
+		{
+			method: http.MethodGet, path: "/v1/races/2",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"RateLimit-Remaining": "1",
+				"RateLimit-Reset":     "4",
+			},
+		},
+		{
+			// A backend refusing the call has its retry delay passed on.
+			method: http.MethodGet, path: "/v1/meetings/1",
+			status: http.StatusTooManyRequests,
+			headers: map[string]string{
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "6",
+				"Retry-After":         "3",
+			},
+		},
+		{
+			// Requests which don't reach a backend aren't limited.
+			method: http.MethodGet, path: "/v1/unknown",
+			status: http.StatusNotFound,
+			headers: map[string]string{
+				"RateLimit-Limit":     "",
+				"RateLimit-Remaining": "",
+				"RateLimit-Reset":     "",
+				"RateLimit-Policy":    "",
+			},
+		},
+	}
+
+	for i, s := range steps {
+		clock.now = clock.now.Add(s.advance)
+
+		r := httptest.NewRequest(s.method, s.path, strings.NewReader("{}"))
+		if s.remoteAddr != "" {
+			r.RemoteAddr = s.remoteAddr
+		}
+		w := httptest.NewRecorder()
+
+		gateway.ServeHTTP(w, r)
+
+		if w.Code != s.status {
+			t.Fatalf("step %d: %s %s status = %d, want %d: %s", i, s.method, s.path, w.Code, s.status, w.Body)
+		}
+
+		if _, ok := s.headers["Retry-After"]; !ok {
+			s.headers["Retry-After"] = ""
+		}
+
+		for header, want := range s.headers {
+			if got := w.Header().Get(header); got != want {
+				t.Errorf("step %d: %s %s %s = %q, want %q", i, s.method, s.path, header, got, want)
+			}
+		}
+	}
+}
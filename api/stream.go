@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"github.com/gorilla/websocket"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// sseRetry is how long browsers wait before reconnecting a dropped
+// Server-Sent Events stream.
+const sseRetry = 3 * time.Second
+
+// eventMarshaler matches the JSON the gateway produces for unary calls.
+var eventMarshaler = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// raceEvents bridges the racing service's WatchRaces stream onto
+// Server-Sent Events and WebSockets, so browsers can follow race changes
+// without a gRPC-web proxy.
+//
+// Both endpoints take the watch filter as query parameters, e.g.
+// ?filter.visible=true&filter.meeting_ids=1. Every event after the initial
+// snapshot carries the sequence it was published at as its id. Reconnecting
+// clients pass the last id they saw, via the Last-Event-ID header or the
+// last_event_id query parameter, to resume without a fresh snapshot.
+type raceEvents struct {
+	client    racing.RacingClient
+	heartbeat time.Duration
+	upgrader  websocket.Upgrader
+
+	// done is closed on shutdown, to end open streams.
+	done     chan struct{}
+	shutdown sync.Once
+}
+
+// newRaceEvents creates a bridge onto client, sending a heartbeat to idle
+// streams at the given interval.
+func newRaceEvents(client racing.RacingClient, heartbeat time.Duration) *raceEvents {
+	return &raceEvents{client: client, heartbeat: heartbeat, done: make(chan struct{})}
+}
+
+// Shutdown ends open streams, as they'd otherwise hold up the server
+// stopping. SSE clients reconnect after sseRetry, and WebSocket clients are
+// told we're going away.
+func (e *raceEvents) Shutdown() {
+	e.shutdown.Do(func() {
+		close(e.done)
+	})
+}
+
+// register adds the SSE and WebSocket endpoints to mux.
+func (e *raceEvents) register(mux *runtime.ServeMux) error {
+	if err := handlePath(mux, http.MethodGet, "/v1/race-events", e.serveSSE); err != nil {
+		return err
+	}
+
+	return handlePath(mux, http.MethodGet, "/v1/race-events/ws", e.serveWebSocket)
+}
+
+// streamPaths are the paths whose responses stream for as long as the client
+// keeps watching: the SSE and WebSocket endpoints, and the gateway's own
+// newline delimited WatchRaces stream.
+var streamPaths = map[string]bool{
+	"/v1/race-events":    true,
+	"/v1/race-events/ws": true,
+	"/v1/watch-races":    true,
+}
+
+// withoutStreamTimeouts lifts the server's read and write timeouts from
+// streams, which would otherwise be cut off once they ran out. The read
+// deadline is lifted too, as it's left on the connection a WebSocket takes
+// over, and ends HTTP/1.1 streams as the server watches for the client
+// closing. It must wrap the handler the server is given, before anything
+// wraps w in a type http.ResponseController can't unwrap.
+func withoutStreamTimeouts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamPaths[r.URL.Path] {
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(time.Time{}); err != nil {
+				log.WithError(err).Warn("failed lifting read timeout from stream")
+			}
+			if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+				log.WithError(err).Warn("failed lifting write timeout from stream")
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// watch parses the watch request from r and opens the upstream stream.
+func (e *raceEvents) watch(ctx context.Context, r *http.Request) (racing.Racing_WatchRacesClient, error) {
+	in := &racing.WatchRacesRequest{}
+
+	query := r.URL.Query()
+	query.Del("last_event_id")
+	if err := runtime.PopulateQueryParameters(in, query, utilities.NewDoubleArray(nil)); err != nil {
+		return nil, err
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	if lastEventID != "" {
+		resumeAfter, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last event id %q", lastEventID)
+		}
+
+		in.ResumeAfter = resumeAfter
+	}
+
+	return e.client.WatchRaces(ctx, in)
+}
+
+// writeWatchError replies to a request whose stream couldn't be opened.
+// Errors from the racing service, such as the caller being unauthenticated
+// or rate limited, keep the status the gateway would give them, while the
+// rest are down to a bad request.
+func writeWatchError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if st, ok := status.FromError(err); ok {
+		code = runtime.HTTPStatusFromCode(st.Code())
+		if st.Code() == codes.Unauthenticated {
+			w.Header().Set("WWW-Authenticate", authChallenge)
+		}
+		setRetryAfter(w.Header(), err)
+	}
+
+	http.Error(w, err.Error(), code)
+}
+
+// recv pumps events from stream onto a channel, so they can be interleaved
+// with heartbeats. The error channel receives the error which ended the
+// stream.
+func recv(stream racing.Racing_WatchRacesClient) (<-chan *racing.WatchRacesResponse, <-chan error) {
+	events := make(chan *racing.WatchRacesResponse)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(events)
+
+		for {
+			event, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			select {
+			case events <- event:
+			case <-stream.Context().Done():
+				errs <- stream.Context().Err()
+				return
+			}
+		}
+	}()
+
+	return events, errs
+}
+
+// eventID returns the id an event is sent with. Snapshot events have none,
+// so a client which drops mid-snapshot doesn't resume part way through it.
+func eventID(event *racing.WatchRacesResponse) string {
+	if event.Type == racing.WatchRacesResponse_SNAPSHOT {
+		return ""
+	}
+
+	return strconv.FormatUint(event.Sequence, 10)
+}
+
+func (e *raceEvents) serveSSE(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := e.watch(ctx, r)
+	if err != nil {
+		writeWatchError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(e.heartbeat)
+	defer heartbeat.Stop()
+
+	events, errs := recv(stream)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case event, ok := <-events:
+			if !ok {
+				writeSSEError(w, <-errs)
+				flusher.Flush()
+				return
+			}
+
+			data, err := eventMarshaler.Marshal(event)
+			if err != nil {
+				log.Errorf("failed marshalling race event: %s", err)
+				return
+			}
+
+			if id := eventID(event); id != "" {
+				fmt.Fprintf(w, "id: %s\n", id)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", strings.ToLower(event.Type.String()), data)
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeSSEError sends the error which ended an upstream stream as a final
+// "error" event.
+func writeSSEError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+
+	data, marshalErr := protojson.Marshal(st.Proto())
+	if marshalErr != nil {
+		log.Errorf("failed marshalling race event error: %s", marshalErr)
+		return
+	}
+
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+}
+
+func (e *raceEvents) serveWebSocket(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	stream, err := e.watch(ctx, r)
+	if err != nil {
+		writeWatchError(w, err)
+		return
+	}
+
+	conn, err := e.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied to the client.
+		return
+	}
+	defer conn.Close()
+
+	// Read, and discard, anything the client sends, so that control frames
+	// are processed and a closed connection cancels the upstream stream.
+	conn.SetReadDeadline(time.Now().Add(2 * e.heartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * e.heartbeat))
+	})
+	go func() {
+		defer cancel()
+
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(e.heartbeat)
+	defer heartbeat.Stop()
+
+	events, errs := recv(stream)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.done:
+			conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second),
+			)
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(e.heartbeat)); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				st := status.Convert(<-errs)
+				conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, st.Message()),
+					time.Now().Add(time.Second),
+				)
+				return
+			}
+
+			data, err := eventMarshaler.Marshal(event)
+			if err != nil {
+				log.Errorf("failed marshalling race event: %s", err)
+				return
+			}
+
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/api/proto/racing"
+	"github.com/gorilla/websocket"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWithoutStreamTimeouts(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	// Responses are written after the write timeout has passed.
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(3 * timeout)
+		w.Write([]byte("ok"))
+	})
+
+	server := httptest.NewUnstartedServer(withoutStreamTimeouts(slow))
+	server.Config.ReadTimeout = timeout
+	server.Config.WriteTimeout = timeout
+	server.Start()
+	defer server.Close()
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{path: "/v1/race-events", ok: true},
+		{path: "/v1/watch-races", ok: true},
+		{path: "/v1/list-races"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			if err == nil {
+				var body []byte
+				body, err = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil && string(body) != "ok" {
+					t.Fatalf("body = %q, want %q", body, "ok")
+				}
+			}
+
+			if ok := err == nil; ok != tt.ok {
+				t.Errorf("response written after the write timeout = %v (%v), want %v", ok, err, tt.ok)
+			}
+		})
+	}
+}
+
+// watchRacingServer streams a fixed set of events to every watcher, then
+// ends the stream with err, or holds it open when err is nil.
+type watchRacingServer struct {
+	racing.UnimplementedRacingServer
+
+	events []*racing.WatchRacesResponse
+	err    error
+
+	// requests receives each watch request.
+	requests chan *racing.WatchRacesRequest
+}
+
+func newWatchRacingServer(err error, events ...*racing.WatchRacesResponse) *watchRacingServer {
+	return &watchRacingServer{events: events, err: err, requests: make(chan *racing.WatchRacesRequest, 1)}
+}
+
+func (s *watchRacingServer) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	s.requests <- in
+
+	for _, event := range s.events {
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+
+	<-stream.Context().Done()
+
+	return nil
+}
+
+// newRaceEventsServer serves the race event endpoints, bridging onto srv,
+// behind withMetrics as the gateway does.
+func newRaceEventsServer(t *testing.T, srv racing.RacingServer, heartbeat time.Duration) *httptest.Server {
+	t.Helper()
+
+	mux := runtime.NewServeMux()
+	events := newRaceEvents(racing.NewRacingClient(serveRacing(t, srv)), heartbeat)
+	if err := events.register(mux); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(withMetrics(mux))
+	t.Cleanup(server.Close)
+	// Open streams must end before the server can close.
+	t.Cleanup(events.Shutdown)
+
+	return server
+}
+
+// sseEvent is a single Server-Sent Event.
+type sseEvent struct {
+	id, event, data, retry string
+}
+
+// readSSE reads the next event from r, skipping comments.
+func readSSE(r *bufio.Reader) (sseEvent, error) {
+	var event sseEvent
+	var fields int
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return event, err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && fields > 0:
+			return event, nil
+		case line == "" || strings.HasPrefix(line, ":"):
+			continue
+		}
+
+		fields++
+		name, value, _ := strings.Cut(line, ": ")
+		switch name {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			event.data = value
+		case "retry":
+			event.retry = value
+		default:
+			return event, fmt.Errorf("unexpected field %q", line)
+		}
+	}
+}
+
+// checkEvent checks data is event, as the JSON the gateway sends.
+func checkEvent(t *testing.T, data []byte, event *racing.WatchRacesResponse) {
+	t.Helper()
+
+	got := &racing.WatchRacesResponse{}
+	if err := protojson.Unmarshal(data, got); err != nil {
+		t.Fatalf("event %s: %s", data, err)
+	}
+
+	if !proto.Equal(got, event) {
+		t.Errorf("event = %v, want %v", got, event)
+	}
+}
+
+func TestRaceEventsSSE(t *testing.T) {
+	snapshot := &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_SNAPSHOT, Race: &racing.Race{Id: 1, Name: "Alpha"}, Sequence: 4}
+	complete := &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_SNAPSHOT_COMPLETE, Sequence: 4}
+	updated := &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_UPDATED, Race: &racing.Race{Id: 1, Name: "Bravo"}, Sequence: 5}
+
+	srv := newWatchRacingServer(status.Error(codes.Unavailable, "racing restarting"), snapshot, complete, updated)
+	server := newRaceEventsServer(t, srv, time.Minute)
+
+	resp, err := http.Get(server.URL + "/v1/race-events?filter.visible=true&filter.meeting_ids=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	in := <-srv.requests
+	if !in.GetFilter().GetVisible() || len(in.GetFilter().GetMeetingIds()) != 1 || in.Filter.MeetingIds[0] != 2 {
+		t.Errorf("watch filter = %v, want visible races of meeting 2", in.Filter)
+	}
+	if in.ResumeAfter != 0 {
+		t.Errorf("resume_after = %d, want 0", in.ResumeAfter)
+	}
+
+	body := bufio.NewReader(resp.Body)
+	next := func() sseEvent {
+		t.Helper()
+
+		event, err := readSSE(body)
+		if err != nil {
+			t.Fatalf("reading event: %s", err)
+		}
+
+		return event
+	}
+
+	if event := next(); event.retry != "3000" {
+		t.Errorf("first event = %+v, want retry: 3000", event)
+	}
+
+	// Snapshot events carry no id, so a client dropping mid-snapshot starts
+	// over rather than resuming part way through it.
+	for _, want := range []struct {
+		id, event string
+		sent      *racing.WatchRacesResponse
+	}{
+		{"", "snapshot", snapshot},
+		{"4", "snapshot_complete", complete},
+		{"5", "updated", updated},
+	} {
+		event := next()
+		if event.id != want.id || event.event != want.event {
+			t.Errorf("event id %q, type %q, want id %q, type %q", event.id, event.event, want.id, want.event)
+		}
+		checkEvent(t, []byte(event.data), want.sent)
+	}
+
+	// The upstream error ends the stream with an error event.
+	event := next()
+	if event.event != "error" {
+		t.Fatalf("event type %q, want error", event.event)
+	}
+
+	st := &spb.Status{}
+	if err := protojson.Unmarshal([]byte(event.data), st); err != nil {
+		t.Fatalf("error event %s: %s", event.data, err)
+	}
+	if codes.Code(st.Code) != codes.Unavailable || st.Message != "racing restarting" {
+		t.Errorf("error event = %v, want Unavailable: racing restarting", st)
+	}
+
+	if event, err := readSSE(body); err != io.EOF {
+		t.Errorf("after the error event read %+v, %v, want EOF", event, err)
+	}
+}
+
+func TestRaceEventsResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		header string
+
+		status      int
+		resumeAfter uint64
+	}{
+		{name: "fresh", status: http.StatusOK},
+		{name: "Last-Event-ID header", header: "7", status: http.StatusOK, resumeAfter: 7},
+		{name: "last_event_id query", query: "?last_event_id=8", status: http.StatusOK, resumeAfter: 8},
+		{
+			// Browsers send the header when reconnecting, which is more
+			// recent than the id the page was opened with.
+			name:   "header and query",
+			query:  "?last_event_id=8",
+			header: "9",
+			status: http.StatusOK, resumeAfter: 9,
+		},
+		{name: "invalid id", header: "latest", status: http.StatusBadRequest},
+		{name: "negative id", query: "?last_event_id=-1", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newWatchRacingServer(status.Error(codes.Unavailable, "racing restarting"))
+			server := newRaceEventsServer(t, srv, time.Minute)
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/race-events"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Last-Event-ID", tt.header)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+
+			select {
+			case in := <-srv.requests:
+				if tt.status != http.StatusOK {
+					t.Errorf("watched with %v, want no watch", in)
+				} else if in.ResumeAfter != tt.resumeAfter {
+					t.Errorf("resume_after = %d, want %d", in.ResumeAfter, tt.resumeAfter)
+				}
+			default:
+				if tt.status == http.StatusOK {
+					t.Error("racing service wasn't watched")
+				}
+			}
+		})
+	}
+}
+
+func TestRaceEventsHeartbeat(t *testing.T) {
+	srv := newWatchRacingServer(nil)
+	server := newRaceEventsServer(t, srv, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/race-events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// An idle stream gets a heartbeat comment every interval.
+	body := bufio.NewReader(resp.Body)
+	for heartbeats := 0; heartbeats < 3; {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %d heartbeats: %s", heartbeats, err)
+		}
+
+		switch line {
+		case ": heartbeat\n":
+			heartbeats++
+		case "\n", "retry: 3000\n":
+		default:
+			t.Fatalf("unexpected line %q on an idle stream", line)
+		}
+	}
+}
+
+func TestRaceEventsWebSocket(t *testing.T) {
+	snapshot := &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_SNAPSHOT, Race: &racing.Race{Id: 1, Name: "Alpha"}, Sequence: 4}
+	updated := &racing.WatchRacesResponse{Type: racing.WatchRacesResponse_UPDATED, Race: &racing.Race{Id: 1, Name: "Bravo"}, Sequence: 5}
+
+	srv := newWatchRacingServer(status.Error(codes.Unavailable, "racing restarting"), snapshot, updated)
+	server := newRaceEventsServer(t, srv, time.Minute)
+
+	upgraded := httpRequests.WithLabelValues("/v1/race-events/ws", http.MethodGet, "101")
+	before := testutil.ToFloat64(upgraded)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/race-events/ws?last_event_id=3"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	if in := <-srv.requests; in.ResumeAfter != 3 {
+		t.Errorf("resume_after = %d, want 3", in.ResumeAfter)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []*racing.WatchRacesResponse{snapshot, updated} {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != websocket.TextMessage {
+			t.Errorf("message type %d, want text", kind)
+		}
+		checkEvent(t, data, want)
+	}
+
+	// The upstream error closes the socket, asking the client to retry.
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "racing restarting" {
+		t.Errorf("read after the upstream error: %v, want close %d: racing restarting", err, websocket.CloseTryAgainLater)
+	}
+
+	// The upgrade is recorded, through statusRecorder's Hijack, once the
+	// handler returns.
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(upgraded) != before+1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v upgraded requests recorded, want %v", testutil.ToFloat64(upgraded), before+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
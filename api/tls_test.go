@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/tlsreload"
+	"git.neds.sh/matty/entain/internal/platform/tlstest"
+)
+
+// serveHTTPS serves a handler answering with the protocol it was called over
+// with serverTLSConfig, until the test ends.
+func serveHTTPS(t *testing.T, certFile, keyFile string) string {
+	t.Helper()
+
+	config, err := serverTLSConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+		TLSConfig: config,
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	return "https://localhost:" + portOf(t, ln.Addr())
+}
+
+func portOf(t *testing.T, addr net.Addr) string {
+	t.Helper()
+
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return port
+}
+
+// get fetches url trusting caFile, over HTTP/1.1 only when http1 is set,
+// returning the protocol the server saw and the certificate it presented.
+func get(t *testing.T, url, caFile string, http1 bool) (string, []byte, error) {
+	t.Helper()
+
+	files, err := tlsreload.Load("", "", caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := tlsreload.ClientConfig(files, "localhost")
+	if http1 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	transport := &http.Transport{TLSClientConfig: config, ForceAttemptHTTP2: !http1}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+
+	proto, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(proto), resp.TLS.PeerCertificates[0].Raw, nil
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	certs := tlstest.New(t, "localhost")
+	url := serveHTTPS(t, certs.ServerCert, certs.ServerKey)
+
+	tests := []struct {
+		name  string
+		http1 bool
+		proto string
+	}{
+		{name: "HTTP/2", proto: "HTTP/2.0"},
+		{name: "HTTP/1.1", http1: true, proto: "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			proto, _, err := get(t, url, certs.CA, tt.http1)
+			if err != nil {
+				t.Fatalf("get: %s", err)
+			}
+
+			if proto != tt.proto {
+				t.Errorf("served over %s, want %s", proto, tt.proto)
+			}
+		})
+	}
+
+	other := tlstest.New(t, "localhost")
+	if _, _, err := get(t, url, other.CA, false); err == nil {
+		t.Error("get trusting another CA succeeded, want it refused")
+	}
+}
+
+func TestServerTLSConfigReload(t *testing.T) {
+	dir := t.TempDir()
+
+	certs, err := tlstest.Generate(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := serveHTTPS(t, certs.ServerCert, certs.ServerKey)
+
+	_, before, err := get(t, url, certs.CA, false)
+	if err != nil {
+		t.Fatalf("get: %s", err)
+	}
+
+	// Reissue every certificate, the CA included, in place, and give the
+	// server time to notice.
+	if _, err := tlstest.Generate(dir, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(tlsreload.ReloadInterval + 100*time.Millisecond)
+
+	_, after, err := get(t, url, certs.CA, false)
+	if err != nil {
+		t.Fatalf("get trusting the reissued CA: %s", err)
+	}
+
+	reissued, err := ioutil.ReadFile(certs.ServerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(after, before) {
+		t.Fatal("server presented the old certificate after reloading")
+	}
+	if block, _ := pem.Decode(reissued); block == nil || !bytes.Equal(after, block.Bytes) {
+		t.Error("server presented a certificate other than the reissued one")
+	}
+}
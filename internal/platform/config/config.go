@@ -0,0 +1,130 @@
+// Package config fills in flags from environment variables and a config
+// file, so every service can be configured the same way.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// FileFlag names the flag holding the path of the config file.
+const FileFlag = "config"
+
+// Load fills in flags of fs not given on the command line, from environment
+// variables and then the config file named by its FileFlag. Flags therefore
+// take precedence over the environment, which takes precedence over the
+// file, which takes precedence over defaults. Each flag can be set by an
+// environment variable named after it with envPrefix, e.g. RACING_DB_DSN for
+// --db-dsn. It must be called after fs is parsed.
+func Load(fs *flag.FlagSet, envPrefix string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	file := fs.Lookup(FileFlag)
+	if file == nil {
+		return fmt.Errorf("no --%s flag", FileFlag)
+	}
+
+	if !set[FileFlag] {
+		if env, ok := os.LookupEnv(EnvName(envPrefix, FileFlag)); ok {
+			if err := file.Value.Set(env); err != nil {
+				return err
+			}
+		}
+	}
+	path := file.Value.String()
+
+	settings, err := readFile(path)
+	if err != nil {
+		return err
+	}
+
+	for name := range settings {
+		if fs.Lookup(name) == nil || name == FileFlag {
+			return fmt.Errorf("unknown setting %q in %s", name, path)
+		}
+	}
+
+	var setErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || f.Name == FileFlag || setErr != nil {
+			return
+		}
+
+		if env, ok := os.LookupEnv(EnvName(envPrefix, f.Name)); ok {
+			if err := f.Value.Set(env); err != nil {
+				setErr = fmt.Errorf("invalid %s: %w", EnvName(envPrefix, f.Name), err)
+			}
+			return
+		}
+
+		if value, ok := settings[f.Name]; ok {
+			if err := f.Value.Set(value); err != nil {
+				setErr = fmt.Errorf("invalid %s in %s: %w", f.Name, path, err)
+			}
+		}
+	})
+
+	return setErr
+}
+
+// readFile reads the settings in the config file at path, if any. JSON is
+// read as YAML, of which it is a subset.
+func readFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed parsing config %s: %w", path, err)
+	}
+
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("setting %q in %s must be a single value", name, path)
+		case nil:
+			settings[name] = ""
+		default:
+			settings[name] = fmt.Sprint(value)
+		}
+	}
+
+	return settings, nil
+}
+
+// EnvName returns the environment variable which sets the named flag.
+func EnvName(envPrefix, flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Log logs the value of every flag in fs, passed through redact to hide
+// secrets. redact may be nil when there are none.
+func Log(fs *flag.FlagSet, redact func(name, value string) string) {
+	fields := log.Fields{}
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if redact != nil {
+			value = redact(f.Name, value)
+		}
+
+		fields[f.Name] = value
+	})
+
+	log.WithFields(fields).Info("effective config")
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+const envPrefix = "TEST_"
+
+// settings are the flags of a service under test.
+type settings struct {
+	fs      *flag.FlagSet
+	config  *string
+	name    *string
+	enabled *bool
+	timeout *time.Duration
+}
+
+func newSettings() *settings {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+
+	return &settings{
+		fs:      fs,
+		config:  fs.String(FileFlag, "", "Config file"),
+		name:    fs.String("service-name", "default", "Name"),
+		enabled: fs.Bool("enabled", false, "Enabled"),
+		timeout: fs.Duration("timeout", time.Second, "Timeout"),
+	}
+}
+
+// writeConfig writes a config file for the test, returning its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name string
+		flag string
+		env  string
+		file string
+		want string
+
+		// emptyEnv sets the variable, though env is empty.
+		emptyEnv bool
+	}{
+		{name: "default", want: "default"},
+		{name: "file", file: "file", want: "file"},
+		{name: "env over file", env: "env", file: "file", want: "env"},
+		{name: "flag over env", flag: "flag", env: "env", want: "flag"},
+		{name: "flag over file", flag: "flag", file: "file", want: "flag"},
+		{name: "flag over env and file", flag: "flag", env: "env", file: "file", want: "flag"},
+		{name: "empty env over file", emptyEnv: true, file: "file", want: ""},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSettings()
+
+			var args []string
+			if tt.flag != "" {
+				args = append(args, "--service-name="+tt.flag)
+			}
+			if tt.file != "" {
+				args = append(args, "--config="+writeConfig(t, "config.yaml", "service-name: "+tt.file+"\n"))
+			}
+			if tt.env != "" || tt.emptyEnv {
+				t.Setenv("TEST_SERVICE_NAME", tt.env)
+			}
+
+			if err := s.fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+			if err := Load(s.fs, envPrefix); err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+
+			if *s.name != tt.want {
+				t.Errorf("service-name = %q, want %q", *s.name, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		format string
+
+		// configEnv names the file with TEST_CONFIG rather than --config.
+		configEnv bool
+
+		enabled bool
+		timeout time.Duration
+		err     string
+	}{
+		{
+			name:    "YAML",
+			file:    "enabled: true\ntimeout: 1m30s\n",
+			enabled: true,
+			timeout: 90 * time.Second,
+		},
+		{
+			name:    "JSON",
+			format:  "json",
+			file:    `{"enabled": true, "timeout": "250ms"}`,
+			enabled: true,
+			timeout: 250 * time.Millisecond,
+		},
+		{
+			name:    "env",
+			env:     map[string]string{"TEST_ENABLED": "1", "TEST_TIMEOUT": "2h"},
+			timeout: 2 * time.Hour,
+			enabled: true,
+		},
+		{
+			name:    "env false over file true",
+			file:    "enabled: true\n",
+			env:     map[string]string{"TEST_ENABLED": "false"},
+			timeout: time.Second,
+		},
+		{
+			name:      "config file from env",
+			configEnv: true,
+			file:      "timeout: 5s\n",
+			timeout:   5 * time.Second,
+		},
+		{
+			name: "invalid bool in env",
+			env:  map[string]string{"TEST_ENABLED": "maybe"},
+			err:  "invalid TEST_ENABLED",
+		},
+		{
+			name: "invalid duration in file",
+			file: "timeout: 5\n",
+			err:  "invalid timeout in",
+		},
+		{
+			name: "unknown setting",
+			file: "enabled: true\ntimeuot: 5s\n",
+			err:  `unknown setting "timeuot"`,
+		},
+		{
+			name: "config file naming itself",
+			file: "config: other.yaml\n",
+			err:  `unknown setting "config"`,
+		},
+		{
+			name: "nested setting",
+			file: "timeout:\n  read: 5s\n",
+			err:  `setting "timeout"`,
+		},
+		{
+			name: "malformed file",
+			file: "enabled: [true\n",
+			err:  "failed parsing config",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSettings()
+
+			var args []string
+			if tt.file != "" {
+				format := tt.format
+				if format == "" {
+					format = "yaml"
+				}
+				path := writeConfig(t, "config."+format, tt.file)
+
+				if tt.configEnv {
+					t.Setenv("TEST_CONFIG", path)
+				} else {
+					args = append(args, "--config="+path)
+				}
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			if err := s.fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := Load(s.fs, envPrefix)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Load = %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+
+			if *s.enabled != tt.enabled {
+				t.Errorf("enabled = %t, want %t", *s.enabled, tt.enabled)
+			}
+			if *s.timeout != tt.timeout {
+				t.Errorf("timeout = %s, want %s", *s.timeout, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	s := newSettings()
+	if err := s.fs.Parse([]string{"--config=" + filepath.Join(t.TempDir(), "missing.yaml")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Load(s.fs, envPrefix); err == nil {
+		t.Error("Load succeeded with a missing config file")
+	}
+}
+
+func TestLoadWithoutFileFlag(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("service-name", "default", "Name")
+
+	if err := Load(fs, envPrefix); err == nil {
+		t.Error("Load succeeded without a --config flag")
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("RACING_", "db-dsn"); got != "RACING_DB_DSN" {
+		t.Errorf("EnvName = %q, want RACING_DB_DSN", got)
+	}
+}
+
+func TestLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("service-name", "racing", "Name")
+	fs.String("secret", "hunter2", "Secret")
+
+	Log(fs, func(name, value string) string {
+		if name == "secret" {
+			return "redacted"
+		}
+
+		return value
+	})
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("nothing logged")
+	}
+
+	if entry.Data["service-name"] != "racing" {
+		t.Errorf("service-name logged as %v, want racing", entry.Data["service-name"])
+	}
+	if entry.Data["secret"] != "redacted" {
+		t.Errorf("secret logged as %v, want redacted", entry.Data["secret"])
+	}
+}
@@ -0,0 +1,59 @@
+// Package metrics serves Prometheus metrics apart from a service's own
+// traffic, so every service exposes them the same way.
+package metrics
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Timeouts of the metrics server, which only ever has scrapers for clients.
+// Scrapes are small and quick, so these are enough for even a slow scraper,
+// while not letting stalled connections pile up.
+const (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// Serve serves the metrics of the default Prometheus registry at /metrics on
+// ln, until the returned server is shut down.
+func Serve(ln net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	log.Infof("metrics server listening on: %s", ln.Addr())
+
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Errorf("failed serving metrics: %s", err)
+		}
+	}()
+
+	return server
+}
+
+// Shutdown stops server once in-flight scrapes have finished, or cuts them
+// off after timeout.
+func Shutdown(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := Serve(ln)
+	defer server.Close()
+
+	// Stalled scrapers can't hold connections open forever.
+	if server.ReadHeaderTimeout <= 0 || server.ReadTimeout <= 0 || server.WriteTimeout <= 0 || server.IdleTimeout <= 0 {
+		t.Errorf("metrics server timeouts: read header %s, read %s, write %s, idle %s, want them all set",
+			server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+
+	url := "http://" + ln.Addr().String()
+
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/metrics = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("/metrics doesn't include the default registry's metrics:\n%s", body)
+	}
+
+	resp, err = http.Get(url + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/ = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	Shutdown(server, time.Second)
+
+	if resp, err := http.Get(url + "/metrics"); err == nil {
+		resp.Body.Close()
+		t.Error("metrics still served after Shutdown")
+	}
+}
@@ -0,0 +1,160 @@
+// Package ratelimit limits how often each caller may do something, with a
+// token bucket per caller.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// SweepInterval is the least time between sweeps of the buckets of callers
+// which have gone quiet.
+const SweepInterval = time.Minute
+
+// Limit is how often a caller may do something: Rate times a second on
+// average, in bursts of up to Burst.
+type Limit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// Validate checks the limit lets callers do anything at all.
+func (l Limit) Validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("rate must be positive and burst at least 1, got rate %g and burst %d", l.Rate, l.Burst)
+	}
+
+	return nil
+}
+
+// Window is how long an empty bucket takes to refill.
+func (l Limit) Window() time.Duration {
+	return seconds(float64(l.Burst) / l.Rate)
+}
+
+// Quota is where a caller stands after trying to take a token.
+type Quota struct {
+	Allowed   bool
+	Remaining int
+
+	// Reset is how long until the bucket is full again, and RetryAfter how
+	// long until it next has a token.
+	Reset, RetryAfter time.Duration
+}
+
+// Limiter keeps a token bucket for each key it's asked to limit.
+type Limiter struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	swept   time.Time
+	buckets map[string]*bucket
+}
+
+// bucket holds the tokens left to a key, as of when it was last taken from.
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// New creates a limiter whose clock reads now.
+func New(now func() time.Time) *Limiter {
+	return &Limiter{now: now, swept: now(), buckets: make(map[string]*bucket)}
+}
+
+// Take takes a token from key's bucket, which holds up to limit.Burst tokens
+// and gains limit.Rate of them a second. A bucket whose limit has changed
+// starts afresh.
+func (l *Limiter) Take(key string, limit Limit) Quota {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now)
+
+	q := Quota{Allowed: b.tokens >= 1}
+	if q.Allowed {
+		b.tokens--
+	} else {
+		q.RetryAfter = seconds((1 - b.tokens) / limit.Rate)
+	}
+
+	q.Remaining = int(b.tokens)
+	q.Reset = seconds((float64(limit.Burst) - b.tokens) / limit.Rate)
+
+	return q
+}
+
+// sweep forgets buckets which have refilled, as taking from them again is
+// the same as starting afresh, so callers which have gone away don't take up
+// memory for good.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < SweepInterval {
+		return
+	}
+	l.swept = now
+
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// refill adds the tokens gained since the bucket was last refilled.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed.Seconds()*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// Error is the ResourceExhausted error of a call refused for exceeding its
+// limit, with a RetryInfo detail telling the caller when to retry.
+func Error(retryAfter time.Duration) error {
+	st, err := status.New(codes.ResourceExhausted, "rate limit exceeded").WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(retryAfter),
+	})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+	}
+
+	return st.Err()
+}
+
+// RetryAfter returns the retry delay of a ResourceExhausted err, if it has
+// one.
+func RetryAfter(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return 0, false
+	}
+
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+
+	return 0, false
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
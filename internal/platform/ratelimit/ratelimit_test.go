@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// clock is a fake clock, which only moves when advanced.
+type clock struct {
+	now time.Time
+}
+
+func newClock() *clock {
+	return &clock{now: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestLimitValidate(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		err   bool
+	}{
+		{limit: Limit{Rate: 1, Burst: 1}},
+		{limit: Limit{Rate: 0.5, Burst: 10}},
+		{limit: Limit{Rate: 0, Burst: 1}, err: true},
+		{limit: Limit{Rate: -1, Burst: 1}, err: true},
+		{limit: Limit{Rate: 1, Burst: 0}, err: true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.limit.Validate(); (err != nil) != tt.err {
+			t.Errorf("%+v.Validate() = %v, want error %v", tt.limit, err, tt.err)
+		}
+	}
+}
+
+func TestLimitWindow(t *testing.T) {
+	if window := (Limit{Rate: 2, Burst: 10}).Window(); window != 5*time.Second {
+		t.Errorf("window = %s, want 5s", window)
+	}
+}
+
+func TestTakeBurst(t *testing.T) {
+	c := newClock()
+	l := New(c.Now)
+	limit := Limit{Rate: 1, Burst: 3}
+
+	// A new caller may use its whole burst straight away.
+	for want := 2; want >= 0; want-- {
+		q := l.Take("caller", limit)
+		if !q.Allowed {
+			t.Fatalf("take refused with %d tokens left", want+1)
+		}
+
+		if q.Remaining != want {
+			t.Errorf("remaining = %d, want %d", q.Remaining, want)
+		}
+		if reset := time.Duration(3-want) * time.Second; q.Reset != reset {
+			t.Errorf("reset = %s, want %s", q.Reset, reset)
+		}
+	}
+
+	// Then it's refused until a token has refilled.
+	q := l.Take("caller", limit)
+	want := Quota{Allowed: false, Remaining: 0, Reset: 3 * time.Second, RetryAfter: time.Second}
+	if q != want {
+		t.Errorf("quota = %+v, want %+v", q, want)
+	}
+
+	// Other callers have buckets of their own.
+	if q := l.Take("other", limit); !q.Allowed || q.Remaining != 2 {
+		t.Errorf("other caller's quota = %+v, want allowed with 2 remaining", q)
+	}
+}
+
+func TestTakeRefill(t *testing.T) {
+	c := newClock()
+	l := New(c.Now)
+	limit := Limit{Rate: 2, Burst: 2}
+
+	l.Take("caller", limit)
+	l.Take("caller", limit)
+
+	// Part of a token isn't enough.
+	c.advance(250 * time.Millisecond)
+	q := l.Take("caller", limit)
+	if q.Allowed {
+		t.Fatal("take allowed with half a token")
+	}
+	if q.RetryAfter != 250*time.Millisecond {
+		t.Errorf("retry after = %s, want 250ms", q.RetryAfter)
+	}
+
+	// A whole one is.
+	c.advance(250 * time.Millisecond)
+	if q := l.Take("caller", limit); !q.Allowed || q.Remaining != 0 {
+		t.Errorf("quota = %+v, want allowed with 0 remaining", q)
+	}
+
+	// The bucket refills to no more than its burst, however long the caller
+	// is away.
+	c.advance(time.Hour)
+	if q := l.Take("caller", limit); !q.Allowed || q.Remaining != 1 {
+		t.Errorf("quota = %+v, want allowed with 1 remaining", q)
+	}
+}
+
+func TestTakeLimitChanged(t *testing.T) {
+	c := newClock()
+	l := New(c.Now)
+
+	l.Take("caller", Limit{Rate: 1, Burst: 1})
+	if q := l.Take("caller", Limit{Rate: 1, Burst: 1}); q.Allowed {
+		t.Fatal("take allowed from an empty bucket")
+	}
+
+	// A new limit starts a full bucket.
+	if q := l.Take("caller", Limit{Rate: 1, Burst: 5}); !q.Allowed || q.Remaining != 4 {
+		t.Errorf("quota = %+v, want allowed with 4 remaining", q)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	c := newClock()
+	l := New(c.Now)
+
+	l.Take("quick", Limit{Rate: 1, Burst: 1})
+	l.Take("slow", Limit{Rate: 1.0 / 3600, Burst: 1})
+
+	// Buckets are only swept once a sweep is due.
+	c.advance(SweepInterval - time.Second)
+	l.Take("new", Limit{Rate: 1, Burst: 10})
+	if len(l.buckets) != 3 {
+		t.Fatalf("%d buckets before the sweep, want 3", len(l.buckets))
+	}
+
+	// Then those which have refilled are forgotten, and the rest kept.
+	c.advance(time.Minute)
+	l.Take("new", Limit{Rate: 1, Burst: 10})
+
+	if _, ok := l.buckets["quick"]; ok {
+		t.Error("refilled bucket kept")
+	}
+	if _, ok := l.buckets["slow"]; !ok {
+		t.Error("bucket still refilling forgotten")
+	}
+	if _, ok := l.buckets["new"]; !ok {
+		t.Error("bucket just taken from forgotten")
+	}
+
+	// A forgotten caller starts afresh, as it would have anyway.
+	if q := l.Take("quick", Limit{Rate: 1, Burst: 1}); !q.Allowed {
+		t.Error("take refused from a forgotten bucket")
+	}
+}
+
+func TestError(t *testing.T) {
+	err := Error(1500 * time.Millisecond)
+
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("code = %s, want ResourceExhausted", code)
+	}
+
+	if retryAfter, ok := RetryAfter(err); !ok || retryAfter != 1500*time.Millisecond {
+		t.Errorf("retry after = %s, %v, want 1.5s", retryAfter, ok)
+	}
+
+	for _, err := range []error{
+		status.Error(codes.ResourceExhausted, "no retry info"),
+		status.Error(codes.Unavailable, "unavailable"),
+		errors.New("not a status"),
+	} {
+		if retryAfter, ok := RetryAfter(err); ok {
+			t.Errorf("retry after of %v = %s, want none", err, retryAfter)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Package tlsreload serves and verifies TLS with certificates loaded from
+// disk, reloading them once their files change, so they can be rotated
+// without a restart.
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadInterval is the least time between checks of whether the files have
+// changed on disk.
+const ReloadInterval = time.Second
+
+// Files holds a certificate pair and CA bundle loaded from disk, reloading
+// them once their files change. Either may be left out.
+type Files struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes []time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// Load loads the named files, failing if they can't be. Empty names are
+// skipped.
+func Load(certFile, keyFile, caFile string) (*Files, error) {
+	f := &Files{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	modTimes, err := f.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.read(modTimes); err != nil {
+		return nil, err
+	}
+	f.checked = time.Now()
+
+	return f, nil
+}
+
+// Current returns the current certificate and CA pool, rereading them if
+// their files have changed. A failed reload is logged, and the files loaded
+// last kept in use, as they may just be part way through being replaced.
+func (f *Files) Current() (*tls.Certificate, *x509.CertPool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if time.Since(f.checked) < ReloadInterval {
+		return f.cert, f.pool
+	}
+	f.checked = time.Now()
+
+	modTimes, err := f.stat()
+	if err != nil {
+		log.Errorf("failed checking TLS files: %s", err)
+		return f.cert, f.pool
+	}
+
+	if !sameTimes(modTimes, f.modTimes) {
+		if err := f.read(modTimes); err != nil {
+			log.Errorf("failed reloading TLS files: %s", err)
+		} else {
+			log.Infof("reloaded TLS files %s", strings.Join(f.names(), ", "))
+		}
+	}
+
+	return f.cert, f.pool
+}
+
+// read loads the files, recording modTimes as the versions loaded.
+func (f *Files) read(modTimes []time.Time) error {
+	var (
+		cert *tls.Certificate
+		pool *x509.CertPool
+	)
+
+	if f.certFile != "" {
+		pair, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return err
+		}
+
+		cert = &pair
+	}
+
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", f.caFile)
+		}
+	}
+
+	f.cert, f.pool, f.modTimes = cert, pool, modTimes
+
+	return nil
+}
+
+// names returns the names of the files loaded.
+func (f *Files) names() []string {
+	var names []string
+
+	for _, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// stat returns when each of the files was last modified.
+func (f *Files) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+
+	for _, name := range f.names() {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	return modTimes, nil
+}
+
+func sameTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ServerConfig serves the certificate in files, requiring clients to present
+// a certificate signed by its CA when it has one. nextProtos are the
+// application protocols offered, e.g. "h2" for gRPC.
+func ServerConfig(files *Files, nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Each handshake gets a config built from the files as they are now.
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := files.Current()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   nextProtos,
+			}
+			if pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig verifies servers against the CA in files, and that their
+// certificate is valid for serverName, presenting its certificate, if any, to
+// those which ask for one.
+func ClientConfig(files *Files, serverName string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		// The usual verification only uses a fixed set of roots, so we skip
+		// it and verify in VerifyConnection instead, against the CA as it is
+		// at the time.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			_, pool := files.Current()
+
+			return verifyServer(state, pool, serverName)
+		},
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := files.Current()
+			if cert == nil {
+				// Sending no certificate leaves it to the server to refuse us.
+				return &tls.Certificate{}, nil
+			}
+
+			return cert, nil
+		},
+	}
+}
+
+// verifyServer checks the server's certificate chains to a root in pool, and
+// is valid for serverName. The name is passed in, as state only has it when
+// it was sent as SNI, which it isn't for IP addresses.
+func verifyServer(state tls.ConnectionState, pool *x509.CertPool, serverName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := state.PeerCertificates[0].Verify(opts)
+
+	return err
+}
@@ -0,0 +1,161 @@
+package tlsreload
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/tlstest"
+)
+
+// serve accepts TLS connections on a local port with config, completing the
+// handshake of each, until the test ends.
+func serve(t *testing.T, config *tls.Config) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// dial connects to addr with config, returning the certificate the server
+// presented once it has accepted us.
+func dial(addr string, config *tls.Config) ([]byte, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// With TLS 1.3 the server only refuses our certificate after the
+	// handshake, so we wait for it to accept us.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		return nil, err
+	}
+
+	return conn.ConnectionState().PeerCertificates[0].Raw, nil
+}
+
+func load(t *testing.T, certFile, keyFile, caFile string) *Files {
+	t.Helper()
+
+	files, err := Load(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestTLS(t *testing.T) {
+	certs := tlstest.New(t, "localhost")
+	addr := serve(t, ServerConfig(load(t, certs.ServerCert, certs.ServerKey, "")))
+
+	if _, err := dial(addr, ClientConfig(load(t, "", "", certs.CA), "localhost")); err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	// The server's certificate isn't valid for other names.
+	if _, err := dial(addr, ClientConfig(load(t, "", "", certs.CA), "example.com")); err == nil {
+		t.Error("dial verifying another name succeeded, want it refused")
+	}
+
+	// Nor is it trusted by clients of another CA.
+	other := tlstest.New(t, "localhost")
+	if _, err := dial(addr, ClientConfig(load(t, "", "", other.CA), "localhost")); err == nil {
+		t.Error("dial trusting another CA succeeded, want it refused")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	certs := tlstest.New(t, "localhost")
+	addr := serve(t, ServerConfig(load(t, certs.ServerCert, certs.ServerKey, certs.CA)))
+
+	if _, err := dial(addr, ClientConfig(load(t, certs.ClientCert, certs.ClientKey, certs.CA), "localhost")); err != nil {
+		t.Fatalf("dial with a client certificate: %s", err)
+	}
+
+	if _, err := dial(addr, ClientConfig(load(t, "", "", certs.CA), "localhost")); err == nil {
+		t.Error("dial without a client certificate succeeded, want it refused")
+	}
+
+	// Client certificates must be signed by the server's CA.
+	other := tlstest.New(t, "localhost")
+	if _, err := dial(addr, ClientConfig(load(t, other.ClientCert, other.ClientKey, certs.CA), "localhost")); err == nil {
+		t.Error("dial with a certificate of another CA succeeded, want it refused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+
+	certs, err := tlstest.Generate(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := serve(t, ServerConfig(load(t, certs.ServerCert, certs.ServerKey, certs.CA)))
+	// The client reloads the reissued CA and certificate too, or it would
+	// no longer trust the server, nor be trusted by it.
+	client := load(t, certs.ClientCert, certs.ClientKey, certs.CA)
+
+	before, err := dial(addr, ClientConfig(client, "localhost"))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+
+	// Reissue every certificate, the CA included, in place.
+	if _, err := tlstest.Generate(dir, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	reissued, err := ioutil.ReadFile(certs.ServerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Until the next check, the certificates loaded first are still used.
+	if presented, err := dial(addr, ClientConfig(client, "localhost")); err != nil {
+		t.Fatalf("dial before reloading: %s", err)
+	} else if !bytes.Equal(presented, before) {
+		t.Error("server presented a new certificate before checking for one")
+	}
+
+	time.Sleep(ReloadInterval + 100*time.Millisecond)
+
+	after, err := dial(addr, ClientConfig(client, "localhost"))
+	if err != nil {
+		t.Fatalf("dial after reloading: %s", err)
+	}
+
+	if bytes.Equal(after, before) {
+		t.Fatal("server presented the old certificate after reloading")
+	}
+	if block, _ := pem.Decode(reissued); block == nil || !bytes.Equal(after, block.Bytes) {
+		t.Error("server presented a certificate other than the reissued one")
+	}
+}
@@ -0,0 +1,35 @@
+// Command gencerts writes a throwaway CA, with server and client certificates
+// signed by it, for trying out TLS between the services locally. Running it
+// again rotates them all.
+//
+//	go run ./tlstest/gencerts -dir ../../certs
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"git.neds.sh/matty/entain/internal/platform/tlstest"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	dir   = flag.String("dir", "certs", "Directory to write the certificates to")
+	hosts = flag.String("hosts", "localhost,127.0.0.1", "Comma separated names and IPs the server certificate is valid for")
+)
+
+func main() {
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("failed creating %s: %s", *dir, err)
+	}
+
+	certs, err := tlstest.Generate(*dir, strings.Split(*hosts, ",")...)
+	if err != nil {
+		log.Fatalf("failed generating certificates: %s", err)
+	}
+
+	log.Infof("wrote CA %s, server %s and client %s", certs.CA, certs.ServerCert, certs.ClientCert)
+}
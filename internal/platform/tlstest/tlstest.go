@@ -0,0 +1,178 @@
+// Package tlstest generates a throwaway CA, with server and client
+// certificates signed by it, so TLS and mutual TLS can be exercised offline.
+// Call it from a test:
+//
+//	certs := tlstest.New(t, "localhost")
+//	pair, err := tls.LoadX509KeyPair(certs.ServerCert, certs.ServerKey)
+//
+// or generate files to run the services with, using the gencerts command.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// validFor is how long generated certificates are valid for.
+const validFor = 24 * time.Hour
+
+// Certs holds the paths of generated PEM files.
+type Certs struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// New generates certificates into a temporary directory, removed once the
+// test ends. The server certificate is valid for hosts, which may be names
+// or IP addresses.
+func New(t *testing.T, hosts ...string) *Certs {
+	t.Helper()
+
+	certs, err := Generate(t.TempDir(), hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certs
+}
+
+// Generate writes a new CA, and server and client certificates signed by it,
+// into dir. Files already there are replaced, so calling it again rotates
+// every certificate, the CA included.
+func Generate(dir string, hosts ...string) (*Certs, error) {
+	certs := &Certs{
+		CA:         filepath.Join(dir, "ca.pem"),
+		ServerCert: filepath.Join(dir, "server.pem"),
+		ServerKey:  filepath.Join(dir, "server-key.pem"),
+		ClientCert: filepath.Join(dir, "client.pem"),
+		ClientKey:  filepath.Join(dir, "client-key.pem"),
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := template("racing test CA")
+	if err != nil {
+		return nil, err
+	}
+	ca.IsCA = true
+	ca.BasicConstraintsValid = true
+	ca.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(certs.CA, "CERTIFICATE", caDER); err != nil {
+		return nil, err
+	}
+
+	server, err := template("racing test server")
+	if err != nil {
+		return nil, err
+	}
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+
+	if err := issue(server, ca, caKey, certs.ServerCert, certs.ServerKey); err != nil {
+		return nil, err
+	}
+
+	client, err := template("racing test client")
+	if err != nil {
+		return nil, err
+	}
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	if err := issue(client, ca, caKey, certs.ClientCert, certs.ClientKey); err != nil {
+		return nil, err
+	}
+
+	return certs, nil
+}
+
+// template returns a certificate template named name, valid from now.
+func template(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+// issue signs cert with the CA, writing it and its new key to files.
+func issue(cert, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER); err != nil {
+		return err
+	}
+
+	return writePEM(certFile, "CERTIFICATE", der)
+}
+
+// writePEM replaces the file at path with a PEM block. The block is written
+// to a temporary file and renamed into place, so it's never read half
+// written.
+func writePEM(path, blockType string, der []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := pem.Encode(tmp, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
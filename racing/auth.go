@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The metadata the gateway forwards its callers' identity in. It's trusted
+// as is, so --auth needs --tls-client-ca, making sure callers hold a
+// certificate, such as the gateway's.
+const (
+	subjectMetadata = "x-auth-subject"
+	scopesMetadata  = "x-auth-scopes"
+)
+
+// The scopes callers are authorized by.
+const (
+	// scopeRead allows reading races, meetings and runners.
+	scopeRead = "races:read"
+
+	// scopeWrite allows creating, updating and deleting races.
+	scopeWrite = "races:write"
+
+	// scopeReadHidden allows seeing races which aren't visible. Without it,
+	// they're left out of lists and watches, and not found by GetRace or
+	// ListRunners.
+	scopeReadHidden = "races:read-hidden"
+)
+
+// methodScopes is the scope each method needs. Methods missing from it are
+// refused, so new methods must be added before they can be called.
+var methodScopes = map[string]string{
+	"/racing.Racing/ListRaces":    scopeRead,
+	"/racing.Racing/GetRace":      scopeRead,
+	"/racing.Racing/WatchRaces":   scopeRead,
+	"/racing.Racing/ListRunners":  scopeRead,
+	"/racing.Racing/ListMeetings": scopeRead,
+	"/racing.Racing/GetMeeting":   scopeRead,
+	"/racing.Racing/CreateRace":   scopeWrite,
+	"/racing.Racing/UpdateRace":   scopeWrite,
+	"/racing.Racing/DeleteRace":   scopeWrite,
+}
+
+// caller is the identity an RPC was made with.
+type caller struct {
+	subject string
+	scopes  map[string]bool
+}
+
+// unaryAuth refuses unary RPCs whose caller lacks the scope the method
+// needs, and hides races which aren't visible from callers who can't see
+// them.
+func unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	c, err := authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return handler(ctx, req)
+	}
+
+	if in, ok := req.(*racing.ListRacesRequest); ok && !c.scopes[scopeReadHidden] {
+		if in.Filter, err = visibleOnly(in.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	// Runners give away the race they're in, so a hidden race's are as
+	// hidden as it is.
+	if in, ok := req.(*racing.ListRunnersRequest); ok && !c.scopes[scopeReadHidden] {
+		if err := checkVisible(ctx, info.Server, in.RaceId); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := handler(ctx, req)
+
+	if race, ok := resp.(*racing.Race); ok && info.FullMethod == "/racing.Racing/GetRace" && !race.Visible && !c.scopes[scopeReadHidden] {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", race.Id)
+	}
+
+	return resp, err
+}
+
+// checkVisible fails with NotFound, as GetRace does, unless the race with id
+// exists and is visible. It's looked up through server, the racing service
+// being called.
+func checkVisible(ctx context.Context, server interface{}, id int64) error {
+	racingServer, ok := server.(racing.RacingServer)
+	if !ok {
+		return status.Errorf(codes.Internal, "can't look up race %d", id)
+	}
+
+	race, err := racingServer.GetRace(ctx, &racing.GetRaceRequest{Id: id})
+	if err != nil {
+		return err
+	}
+
+	if !race.Visible {
+		return status.Errorf(codes.NotFound, "race %d not found", id)
+	}
+
+	return nil
+}
+
+// streamAuth refuses streaming RPCs like unaryAuth, limiting watches to
+// visible races for callers who can't see hidden ones.
+func streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	c, err := authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	if c != nil && !c.scopes[scopeReadHidden] {
+		ss = &visibleOnlyStream{ServerStream: ss}
+	}
+
+	return handler(srv, ss)
+}
+
+// authorize returns the caller of method, or an error if they may not call
+// it. Health checks are open to anyone, and have no caller.
+func authorize(ctx context.Context, method string) (*caller, error) {
+	if strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	subjects := md.Get(subjectMetadata)
+	if len(subjects) != 1 || subjects[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "no caller identity")
+	}
+
+	// The gateway sends the scopes as a single value. Only that is read, so
+	// values added after it can't grant any more.
+	c := &caller{subject: subjects[0], scopes: make(map[string]bool)}
+	if scopes := md.Get(scopesMetadata); len(scopes) > 0 {
+		for _, scope := range strings.Fields(scopes[0]) {
+			c.scopes[scope] = true
+		}
+	}
+
+	scope, ok := methodScopes[method]
+	if !ok {
+		return nil, status.Errorf(codes.PermissionDenied, "%s can't be called", method)
+	}
+
+	if !c.scopes[scope] {
+		return nil, status.Errorf(codes.PermissionDenied, "%s needs the %s scope", method, scope)
+	}
+
+	return c, nil
+}
+
+// visibleOnly limits filter to visible races, refusing one which only asks
+// for hidden races.
+func visibleOnly(filter *racing.ListRacesRequestFilter) (*racing.ListRacesRequestFilter, error) {
+	if filter == nil {
+		filter = &racing.ListRacesRequestFilter{}
+	}
+
+	if filter.Visible != nil && !*filter.Visible {
+		return nil, status.Errorf(codes.PermissionDenied, "seeing hidden races needs the %s scope", scopeReadHidden)
+	}
+
+	visible := true
+	filter.Visible = &visible
+
+	return filter, nil
+}
+
+// visibleOnlyStream limits the WatchRaces request received on it to visible
+// races, and hides what races which have just been hidden have become.
+type visibleOnlyStream struct {
+	grpc.ServerStream
+}
+
+func (s *visibleOnlyStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	in, ok := m.(*racing.WatchRacesRequest)
+	if !ok {
+		return nil
+	}
+
+	var err error
+	in.Filter, err = visibleOnly(in.Filter)
+
+	return err
+}
+
+// SendMsg strips a race which has just been hidden down to its ID, which is
+// all the caller needs to drop it.
+func (s *visibleOnlyStream) SendMsg(m interface{}) error {
+	if resp, ok := m.(*racing.WatchRacesResponse); ok && resp.Race != nil && !resp.Race.Visible {
+		m = &racing.WatchRacesResponse{
+			Type:     resp.Type,
+			Race:     &racing.Race{Id: resp.Race.Id},
+			Sequence: resp.Sequence,
+		}
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
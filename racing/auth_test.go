@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// racesServer serves GetRace from a fixed set of races.
+type racesServer struct {
+	racing.UnimplementedRacingServer
+	races map[int64]*racing.Race
+}
+
+func (s *racesServer) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	race, ok := s.races[in.Id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", in.Id)
+	}
+
+	return race, nil
+}
+
+// callerContext returns the context of an RPC the gateway forwarded for a
+// caller with scopes.
+func callerContext(scopes string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(subjectMetadata, "tester", scopesMetadata, scopes))
+}
+
+func TestUnaryAuthListRunners(t *testing.T) {
+	server := &racesServer{races: map[int64]*racing.Race{
+		1: {Id: 1, Visible: true},
+		2: {Id: 2, Visible: false},
+	}}
+	info := &grpc.UnaryServerInfo{Server: server, FullMethod: "/racing.Racing/ListRunners"}
+
+	tests := []struct {
+		name   string
+		scopes string
+		raceID int64
+		code   codes.Code
+	}{
+		{name: "visible race", scopes: scopeRead, raceID: 1, code: codes.OK},
+		{name: "hidden race", scopes: scopeRead, raceID: 2, code: codes.NotFound},
+		{name: "hidden race with read-hidden", scopes: scopeRead + " " + scopeReadHidden, raceID: 2, code: codes.OK},
+		{name: "missing race", scopes: scopeRead, raceID: 3, code: codes.NotFound},
+		{name: "without read", scopes: scopeWrite, raceID: 1, code: codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				return &racing.ListRunnersResponse{}, nil
+			}
+
+			_, err := unaryAuth(callerContext(tt.scopes), &racing.ListRunnersRequest{RaceId: tt.raceID}, info, handler)
+
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("code = %s, want %s (%v)", code, tt.code, err)
+			}
+
+			if want := tt.code == codes.OK; called != want {
+				t.Errorf("handler called = %v, want %v", called, want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	tests := []struct {
+		name string
+		md   metadata.MD
+		code codes.Code
+	}{
+		{
+			name: "scope granted",
+			md:   metadata.Pairs(subjectMetadata, "tester", scopesMetadata, scopeRead+" "+scopeWrite),
+			code: codes.OK,
+		},
+		{
+			name: "scope missing",
+			md:   metadata.Pairs(subjectMetadata, "tester", scopesMetadata, scopeWrite),
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "no scopes",
+			md:   metadata.Pairs(subjectMetadata, "tester"),
+			code: codes.PermissionDenied,
+		},
+		{
+			// A caller adding its own value after the gateway's gains
+			// nothing from it.
+			name: "scope in a second value",
+			md:   metadata.Pairs(subjectMetadata, "tester", scopesMetadata, scopeWrite, scopesMetadata, scopeRead),
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "no subject",
+			md:   metadata.Pairs(scopesMetadata, scopeRead),
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "several subjects",
+			md:   metadata.Pairs(subjectMetadata, "tester", subjectMetadata, "admin", scopesMetadata, scopeRead),
+			code: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+
+			_, err := authorize(ctx, "/racing.Racing/ListRaces")
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("code = %s, want %s (%v)", code, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestUnaryAuthGetRace(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/racing.Racing/GetRace"}
+
+	tests := []struct {
+		name   string
+		scopes string
+		race   *racing.Race
+		code   codes.Code
+	}{
+		{name: "visible race", scopes: scopeRead, race: &racing.Race{Id: 1, Visible: true}, code: codes.OK},
+		{name: "hidden race", scopes: scopeRead, race: &racing.Race{Id: 2}, code: codes.NotFound},
+		{name: "hidden race with read-hidden", scopes: scopeRead + " " + scopeReadHidden, race: &racing.Race{Id: 2}, code: codes.OK},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return tt.race, nil
+			}
+
+			_, err := unaryAuth(callerContext(tt.scopes), &racing.GetRaceRequest{Id: tt.race.Id}, info, handler)
+
+			if code := status.Code(err); code != tt.code {
+				t.Errorf("code = %s, want %s (%v)", code, tt.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/config"
+	"git.neds.sh/matty/entain/racing/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// envPrefix prefixes the environment variable each flag can be set with,
+// e.g. RACING_DB_DSN for --db-dsn.
+const envPrefix = "RACING_"
+
+var (
+	configFile = flag.String(config.FileFlag, "", "YAML or JSON file of settings, keyed by flag name (also "+envPrefix+"CONFIG)")
+	logLevel   = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+)
+
+// secretFlags are flags whose values are redacted when logged.
+var secretFlags = map[string]bool{
+	"page-token-key": true,
+}
+
+// dsnPassword matches the password in a key=value DSN.
+var dsnPassword = regexp.MustCompile(`(password=)(?:'[^']*'|\S+)`)
+
+// loadConfig fills in flags not given on the command line, from environment
+// variables and then the config file, and validates them. It must be called
+// after flag.Parse.
+func loadConfig() error {
+	if err := config.Load(flag.CommandLine, envPrefix); err != nil {
+		return err
+	}
+
+	return validateConfig()
+}
+
+// validateConfig checks settings which are well formed, but may not make
+// sense together, and applies --log-level.
+func validateConfig() error {
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	log.SetLevel(level)
+
+	if _, err := db.DialectFor(*dbDriver); err != nil && *dbDriver != db.MemoryDriver {
+		return fmt.Errorf("invalid --db-driver %q, expected %s, %s or %s", *dbDriver, db.SQLite.Driver, db.Postgres.Driver, db.MemoryDriver)
+	}
+
+	for name, endpoint := range map[string]string{
+		"grpc-endpoint":    *grpcEndpoint,
+		"metrics-endpoint": *metricsEndpoint,
+	} {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return fmt.Errorf("invalid --%s: %w", name, err)
+		}
+	}
+
+	switch *traceExporter {
+	case "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("invalid --trace-exporter %q, expected none, stdout or otlp", *traceExporter)
+	}
+
+	if *seedDate != "" {
+		if _, err := time.Parse(seedDateLayout, *seedDate); err != nil {
+			return fmt.Errorf("invalid --seed-date %q, expected YYYY-MM-DD", *seedDate)
+		}
+	}
+
+	if *cache && *cacheTTL <= 0 {
+		return fmt.Errorf("invalid --cache-ttl %s, must be positive when caching", *cacheTTL)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be set together")
+	}
+	if *tlsClientCA != "" && *tlsCert == "" {
+		return fmt.Errorf("--tls-client-ca needs --tls-cert, as clients can only present certificates over TLS")
+	}
+	if *auth && *tlsClientCA == "" {
+		return fmt.Errorf("--auth needs --tls-client-ca, as it trusts the caller identity sent by any client able to connect")
+	}
+
+	if *shutdownDelay < 0 || *shutdownTimeout < 0 {
+		return fmt.Errorf("--shutdown-delay and --shutdown-timeout can't be negative")
+	}
+
+	return nil
+}
+
+// logConfig logs the value of every setting, with secrets redacted.
+func logConfig() {
+	config.Log(flag.CommandLine, redact)
+}
+
+// redact hides the secret parts of the named setting's value.
+func redact(name, value string) string {
+	switch {
+	case value == "":
+		return value
+	case secretFlags[name]:
+		return "REDACTED"
+	case name == "db-dsn":
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+
+		return dsnPassword.ReplaceAllString(value, "${1}xxxxx")
+	}
+
+	return value
+}
@@ -0,0 +1,320 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/protobuf/proto"
+)
+
+// cacheMaxEntries bounds how many results the races cache holds. Once it is
+// reached expired entries are swept, and if that isn't enough the cache is
+// emptied.
+const cacheMaxEntries = 10000
+
+// cacheEntry is a cached List or Get result.
+type cacheEntry struct {
+	races   []*racing.Race
+	cursor  *Cursor
+	expires time.Time
+}
+
+// cachedRacesRepo is a read-through cache in front of another RacesRepo.
+type cachedRacesRepo struct {
+	RacesRepo
+
+	ttl   time.Duration
+	now   func() time.Time
+	group singleflight.Group
+
+	mu sync.Mutex
+	// generation is bumped by every invalidation, so loads which began
+	// beforehand don't store their now stale results.
+	generation uint64
+	entries    map[string]cacheEntry
+}
+
+// NewCachedRacesRepo wraps repo with a cache of List and Get results, each
+// held for up to ttl. Concurrent identical reads are collapsed into one, and
+// the cache is emptied by every write through it, and whenever a race closes
+// once WatchClosures is running.
+func NewCachedRacesRepo(repo RacesRepo, ttl time.Duration, now func() time.Time) RacesRepo {
+	return &cachedRacesRepo{
+		RacesRepo: repo,
+		ttl:       ttl,
+		now:       now,
+		entries:   make(map[string]cacheEntry),
+	}
+}
+
+func (c *cachedRacesRepo) List(ctx context.Context, filter *racing.ListRacesRequestFilter, opts ListOptions) ([]*racing.Race, *Cursor, error) {
+	key, err := listCacheKey(filter, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := c.load(ctx, "list", key, func(ctx context.Context) (cacheEntry, error) {
+		races, cursor, err := c.RacesRepo.List(ctx, filter, opts)
+
+		return cacheEntry{races: races, cursor: cursor}, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cloneRaces(entry.races), entry.cursor, nil
+}
+
+func (c *cachedRacesRepo) Get(id int64) (*racing.Race, error) {
+	entry, err := c.load(context.Background(), "get", "get/"+strconv.FormatInt(id, 10), func(context.Context) (cacheEntry, error) {
+		race, err := c.RacesRepo.Get(id)
+
+		return cacheEntry{races: []*racing.Race{race}}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.Clone(entry.races[0]).(*racing.Race), nil
+}
+
+func (c *cachedRacesRepo) Create(race *racing.Race) (*racing.Race, error) {
+	defer c.invalidate()
+
+	return c.RacesRepo.Create(race)
+}
+
+func (c *cachedRacesRepo) Update(race *racing.Race, fields []string) (*racing.Race, error) {
+	defer c.invalidate()
+
+	return c.RacesRepo.Update(race, fields)
+}
+
+func (c *cachedRacesRepo) Delete(id int64, etag string) error {
+	defer c.invalidate()
+
+	return c.RacesRepo.Delete(id, etag)
+}
+
+func (c *cachedRacesRepo) WatchClosures(ctx context.Context, interval time.Duration) {
+	sub := c.RacesRepo.Subscribe(0)
+	go c.invalidateOnClosures(ctx, sub)
+
+	c.RacesRepo.WatchClosures(ctx, interval)
+}
+
+// invalidateOnClosures empties the cache whenever a race closes, as both its
+// status and the results of status filters will have changed.
+func (c *cachedRacesRepo) invalidateOnClosures(ctx context.Context, sub *Subscription) {
+	for {
+		if !c.awaitClosures(ctx, sub) {
+			return
+		}
+
+		// We fell behind the feed, so may have missed a closure.
+		c.invalidate()
+		sub = c.RacesRepo.Subscribe(0)
+	}
+}
+
+// awaitClosures invalidates the cache on each closure published to sub,
+// until ctx is done or sub is dropped. It reports whether sub was dropped.
+func (c *cachedRacesRepo) awaitClosures(ctx context.Context, sub *Subscription) bool {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case change, ok := <-sub.C():
+			if !ok {
+				return true
+			}
+
+			if change.Type == ChangeClosed {
+				c.invalidate()
+			}
+		}
+	}
+}
+
+// load returns the cached entry for key, calling fetch to fill it on a miss.
+// Whether it hit is recorded on the span in ctx.
+func (c *cachedRacesRepo) load(ctx context.Context, method, key string, fetch func(context.Context) (cacheEntry, error)) (cacheEntry, error) {
+	span := trace.SpanFromContext(ctx)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if ok && c.now().Before(entry.expires) {
+		cacheRequests.WithLabelValues(method, "hit").Inc()
+		span.SetAttributes(attribute.String("cache.result", "hit"))
+
+		return entry, nil
+	}
+
+	// Loads are only collapsed within a generation, so a read following a
+	// write never joins one which began before it. Every caller is told the
+	// result was shared, the one which fetched it included, so we note which
+	// that was.
+	var fetched bool
+	v, err, _ := c.group.Do(strconv.FormatUint(generation, 10)+"/"+key, func() (interface{}, error) {
+		fetched = true
+
+		// The load is shared with any identical reads which arrive while it
+		// runs, so it mustn't be cancelled along with the read which began it.
+		entry, err := fetch(detachedContext{ctx})
+		if err != nil {
+			return nil, err
+		}
+
+		entry.expires = c.now().Add(c.ttl)
+		c.store(key, entry, generation)
+
+		return entry, nil
+	})
+
+	result := "miss"
+	if !fetched {
+		result = "shared"
+	}
+	cacheRequests.WithLabelValues(method, result).Inc()
+	span.SetAttributes(attribute.String("cache.result", result))
+
+	if err != nil {
+		return cacheEntry{}, err
+	}
+
+	return v.(cacheEntry), nil
+}
+
+// store caches entry under key, unless the cache has been invalidated since
+// generation.
+func (c *cachedRacesRepo) store(key string, entry cacheEntry, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generation != generation {
+		return
+	}
+
+	if len(c.entries) >= cacheMaxEntries {
+		now := c.now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		if len(c.entries) >= cacheMaxEntries {
+			c.entries = make(map[string]cacheEntry)
+		}
+	}
+
+	c.entries[key] = entry
+}
+
+// invalidate empties the cache.
+func (c *cachedRacesRepo) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]cacheEntry)
+}
+
+// detachedContext keeps the values of the context it wraps, such as the
+// current span, but is never cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// listCacheKey normalises a List call into a cache key, so that requests
+// which differ only in meeting ID order, or in how order_by is spelt, share
+// an entry.
+func listCacheKey(filter *racing.ListRacesRequestFilter, opts ListOptions) (string, error) {
+	terms, err := orderTerms(opts.OrderBy)
+	if err != nil {
+		return "", err
+	}
+
+	orderBy := make([]string, 0, len(terms))
+	for _, term := range terms {
+		if term.desc {
+			orderBy = append(orderBy, term.field+" desc")
+		} else {
+			orderBy = append(orderBy, term.field)
+		}
+	}
+
+	key := struct {
+		MeetingIDs []int64            `json:"m,omitempty"`
+		Visible    *bool              `json:"v,omitempty"`
+		Status     racing.Race_Status `json:"s,omitempty"`
+		OrderBy    string             `json:"o"`
+		PageSize   int                `json:"n,omitempty"`
+		After      *Cursor            `json:"a,omitempty"`
+	}{
+		Status:   filter.GetStatus(),
+		OrderBy:  strings.Join(orderBy, ","),
+		PageSize: opts.PageSize,
+		After:    opts.After,
+	}
+
+	if filter != nil {
+		key.Visible = filter.Visible
+	}
+
+	for _, meetingID := range filter.GetMeetingIds() {
+		if !containsID(key.MeetingIDs, meetingID) {
+			key.MeetingIDs = append(key.MeetingIDs, meetingID)
+		}
+	}
+	sort.Slice(key.MeetingIDs, func(i, j int) bool {
+		return key.MeetingIDs[i] < key.MeetingIDs[j]
+	})
+
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+
+	return "list/" + string(b), nil
+}
+
+// cloneRaces deep copies races, so callers can't modify those cached.
+func cloneRaces(races []*racing.Race) []*racing.Race {
+	if races == nil {
+		return nil
+	}
+
+	clones := make([]*racing.Race, len(races))
+	for i, race := range races {
+		clones[i] = proto.Clone(race).(*racing.Race)
+	}
+
+	return clones
+}
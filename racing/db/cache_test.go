@@ -0,0 +1,514 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// cacheClock is a fake clock, which only moves when advanced.
+type cacheClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newCacheClock() *cacheClock {
+	return &cacheClock{now: time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *cacheClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *cacheClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// countingRacesRepo counts the reads which reach the repo it wraps. When
+// block is set, the first read signals entered then waits for it to close.
+type countingRacesRepo struct {
+	RacesRepo
+
+	lists, gets int32
+
+	block   chan struct{}
+	entered chan struct{}
+	blocked int32
+
+	// feed, when set, is subscribed to in place of the wrapped repo's.
+	feed *changeFeed
+}
+
+func (r *countingRacesRepo) List(ctx context.Context, filter *racing.ListRacesRequestFilter, opts ListOptions) ([]*racing.Race, *Cursor, error) {
+	atomic.AddInt32(&r.lists, 1)
+	r.wait()
+
+	return r.RacesRepo.List(ctx, filter, opts)
+}
+
+func (r *countingRacesRepo) Get(id int64) (*racing.Race, error) {
+	atomic.AddInt32(&r.gets, 1)
+	r.wait()
+
+	return r.RacesRepo.Get(id)
+}
+
+func (r *countingRacesRepo) Subscribe(after uint64) *Subscription {
+	if r.feed != nil {
+		return r.feed.subscribe(after)
+	}
+
+	return r.RacesRepo.Subscribe(after)
+}
+
+func (r *countingRacesRepo) WatchClosures(ctx context.Context, interval time.Duration) {
+	<-ctx.Done()
+}
+
+func (r *countingRacesRepo) wait() {
+	if r.block == nil || !atomic.CompareAndSwapInt32(&r.blocked, 0, 1) {
+		return
+	}
+
+	r.entered <- struct{}{}
+	<-r.block
+}
+
+// newCountingRacesRepo returns a repo of two races, behind a counter.
+func newCountingRacesRepo(t *testing.T, now func() time.Time) *countingRacesRepo {
+	t.Helper()
+
+	start := now().Add(time.Hour)
+
+	mem := NewMemoryDB()
+	err := mem.Seed(&Fixtures{
+		Meetings: []MeetingFixture{
+			{ID: 1, Venue: "Flemington", Country: "AU", RaceType: "THOROUGHBRED", Date: "2030-01-01"},
+		},
+		Races: []RaceFixture{
+			{ID: 1, MeetingID: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: start},
+			{ID: 2, MeetingID: 1, Name: "Bravo", Number: 2, Visible: true, AdvertisedStartTime: start},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &countingRacesRepo{RacesRepo: NewMemoryRacesRepo(mem, now)}
+}
+
+func TestCacheTTL(t *testing.T) {
+	clock := newCacheClock()
+	backend := newCountingRacesRepo(t, clock.Now)
+	cache := NewCachedRacesRepo(backend, time.Minute, clock.Now)
+
+	hits := testutil.ToFloat64(cacheRequests.WithLabelValues("get", "hit"))
+	misses := testutil.ToFloat64(cacheRequests.WithLabelValues("get", "miss"))
+
+	if _, err := cache.Get(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change made behind the cache's back isn't seen until the entry
+	// expires.
+	if _, err := backend.RacesRepo.Update(&racing.Race{Id: 1, Name: "Renamed"}, []string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(time.Minute - time.Nanosecond)
+	race, err := cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if race.Name != "Alpha" || backend.gets != 1 {
+		t.Errorf("before expiry got %q with %d backend reads, want the cached Alpha with 1", race.Name, backend.gets)
+	}
+
+	clock.advance(time.Nanosecond)
+	race, err = cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if race.Name != "Renamed" || backend.gets != 2 {
+		t.Errorf("on expiry got %q with %d backend reads, want Renamed with 2", race.Name, backend.gets)
+	}
+
+	if got := testutil.ToFloat64(cacheRequests.WithLabelValues("get", "hit")) - hits; got != 1 {
+		t.Errorf("hits = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheRequests.WithLabelValues("get", "miss")) - misses; got != 2 {
+		t.Errorf("misses = %v, want 2", got)
+	}
+}
+
+func TestCacheReturnsCopies(t *testing.T) {
+	clock := newCacheClock()
+	cache := NewCachedRacesRepo(newCountingRacesRepo(t, clock.Now), time.Minute, clock.Now)
+
+	race, err := cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	race.Name = "Changed by the caller"
+
+	races, _, err := cache.List(context.Background(), nil, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	races[0].Name = "Changed by the caller"
+
+	if race, err := cache.Get(1); err != nil || race.Name != "Alpha" {
+		t.Errorf("get = %v, %v, want the cached Alpha", race, err)
+	}
+	if races, _, err := cache.List(context.Background(), nil, ListOptions{}); err != nil || races[0].Name != "Alpha" {
+		t.Errorf("list = %v, %v, want the cached Alpha first", races, err)
+	}
+}
+
+func TestCacheInvalidatedByWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(repo RacesRepo) error
+	}{
+		{
+			name: "create",
+			write: func(repo RacesRepo) error {
+				_, err := repo.Create(&racing.Race{MeetingId: 1, Name: "Charlie", Number: 3})
+				return err
+			},
+		},
+		{
+			name: "update",
+			write: func(repo RacesRepo) error {
+				_, err := repo.Update(&racing.Race{Id: 2, Visible: false}, []string{"visible"})
+				return err
+			},
+		},
+		{
+			name: "delete",
+			write: func(repo RacesRepo) error {
+				return repo.Delete(2, "")
+			},
+		},
+		{
+			// A failed write may still have changed something, so empties
+			// the cache too.
+			name: "failed update",
+			write: func(repo RacesRepo) error {
+				if _, err := repo.Update(&racing.Race{Id: 2, Etag: "stale"}, []string{"name"}); err != ErrEtagMismatch {
+					return err
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newCacheClock()
+			backend := newCountingRacesRepo(t, clock.Now)
+			cache := NewCachedRacesRepo(backend, time.Minute, clock.Now)
+
+			filter := &racing.ListRacesRequestFilter{Visible: proto.Bool(true)}
+
+			before, _, err := cache.List(context.Background(), filter, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cache.Get(2); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.write(cache); err != nil {
+				t.Fatal(err)
+			}
+
+			after, _, err := cache.List(context.Background(), filter, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache.Get(2)
+
+			if backend.lists != 2 || backend.gets != 2 {
+				t.Errorf("backend read %d lists and %d gets, want both read again after the write", backend.lists, backend.gets)
+			}
+
+			want, _, err := backend.RacesRepo.List(context.Background(), filter, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(want) {
+				t.Errorf("listed %d races after the write, want %d (%d before)", len(after), len(want), len(before))
+			}
+		})
+	}
+}
+
+func TestCacheStaleLoadNotStored(t *testing.T) {
+	clock := newCacheClock()
+	backend := newCountingRacesRepo(t, clock.Now)
+	backend.block = make(chan struct{})
+	backend.entered = make(chan struct{})
+	cache := NewCachedRacesRepo(backend, time.Minute, clock.Now)
+
+	loaded := make(chan *racing.Race)
+	go func() {
+		race, _ := cache.Get(1)
+		loaded <- race
+	}()
+	<-backend.entered
+
+	// Write while the read is in flight, so what it loaded may be stale.
+	if _, err := cache.Update(&racing.Race{Id: 1, Name: "Renamed"}, []string{"name"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read after the write doesn't join the one in flight.
+	race, err := cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if race.Name != "Renamed" {
+		t.Errorf("get after the write = %q, want Renamed", race.Name)
+	}
+
+	close(backend.block)
+	<-loaded
+
+	// Nor is the stale result stored over the fresh one.
+	race, err = cache.Get(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if race.Name != "Renamed" {
+		t.Errorf("get once the stale read finished = %q, want Renamed", race.Name)
+	}
+	if backend.gets != 2 {
+		t.Errorf("backend read %d times, want 2", backend.gets)
+	}
+}
+
+func TestCacheInvalidatedByClosures(t *testing.T) {
+	clock := newCacheClock()
+	backend := newCountingRacesRepo(t, clock.Now)
+	backend.feed = newChangeFeed(clock.Now())
+	cache := NewCachedRacesRepo(backend, time.Minute, clock.Now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cache.WatchClosures(ctx, time.Second)
+
+	// Wait for the cache to subscribe before publishing.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		backend.feed.mu.Lock()
+		subscribed := len(backend.feed.subs) > 0
+		backend.feed.mu.Unlock()
+
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache never subscribed to the change feed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cache.Get(1)
+
+	// Other changes were made through the cache, so are already accounted
+	// for.
+	backend.feed.publish(ChangeUpdated, &racing.Race{Id: 2}, &racing.Race{Id: 2})
+	backend.feed.publish(ChangeClosed, &racing.Race{Id: 2}, &racing.Race{Id: 2})
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		cache.Get(1)
+		if atomic.LoadInt32(&backend.gets) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("cache not emptied when a race closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheCollapsesConcurrentMisses(t *testing.T) {
+	clock := newCacheClock()
+	backend := newCountingRacesRepo(t, clock.Now)
+	backend.block = make(chan struct{})
+	backend.entered = make(chan struct{})
+	cache := NewCachedRacesRepo(backend, time.Minute, clock.Now)
+
+	const readers = 10
+
+	counts := func() (misses, others float64) {
+		return testutil.ToFloat64(cacheRequests.WithLabelValues("list", "miss")),
+			testutil.ToFloat64(cacheRequests.WithLabelValues("list", "shared")) +
+				testutil.ToFloat64(cacheRequests.WithLabelValues("list", "hit"))
+	}
+	misses, others := counts()
+
+	var wg sync.WaitGroup
+	read := func() {
+		defer wg.Done()
+
+		if _, _, err := cache.List(context.Background(), nil, ListOptions{}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	wg.Add(1)
+	go read()
+	<-backend.entered
+
+	// The rest either join the read in flight or, arriving after it,
+	// find its result cached.
+	for i := 1; i < readers; i++ {
+		wg.Add(1)
+		go read()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	close(backend.block)
+	wg.Wait()
+
+	if backend.lists != 1 {
+		t.Errorf("backend read %d times, want 1", backend.lists)
+	}
+	gotMisses, gotOthers := counts()
+	if gotMisses-misses != 1 || gotOthers-others != readers-1 {
+		t.Errorf("counted %v misses and %v shared or hit, want 1 and %d", gotMisses-misses, gotOthers-others, readers-1)
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	clock := newCacheClock()
+	cache := NewCachedRacesRepo(newCountingRacesRepo(t, clock.Now), time.Minute, clock.Now).(*cachedRacesRepo)
+
+	// fill fills the cache, expiring expired of its entries.
+	fill := func(expired int) {
+		cache.entries = make(map[string]cacheEntry)
+		for i := 0; i < cacheMaxEntries; i++ {
+			expires := clock.Now().Add(time.Minute)
+			if i < expired {
+				expires = clock.Now()
+			}
+			cache.entries[strconv.Itoa(i)] = cacheEntry{expires: expires}
+		}
+	}
+
+	// Below the bound nothing is swept.
+	cache.store("first", cacheEntry{expires: clock.Now()}, cache.generation)
+	if len(cache.entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(cache.entries))
+	}
+
+	// At it, expired entries are.
+	fill(cacheMaxEntries / 2)
+	cache.store("new", cacheEntry{expires: clock.Now().Add(time.Minute)}, cache.generation)
+	if want := cacheMaxEntries/2 + 1; len(cache.entries) != want {
+		t.Errorf("%d entries after sweeping expired ones, want %d", len(cache.entries), want)
+	}
+	if _, ok := cache.entries["new"]; !ok {
+		t.Error("new entry not stored after sweeping expired ones")
+	}
+
+	// And if none have expired, all are.
+	fill(0)
+	cache.store("new", cacheEntry{expires: clock.Now().Add(time.Minute)}, cache.generation)
+	if _, ok := cache.entries["new"]; !ok || len(cache.entries) != 1 {
+		t.Errorf("%d entries after emptying, want only the new one", len(cache.entries))
+	}
+}
+
+func TestListCacheKey(t *testing.T) {
+	key := func(filter *racing.ListRacesRequestFilter, opts ListOptions) string {
+		t.Helper()
+
+		k, err := listCacheKey(filter, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	tests := []struct {
+		name    string
+		a, b    string
+		sameKey bool
+	}{
+		{
+			name:    "meeting ID order and duplicates",
+			a:       key(&racing.ListRacesRequestFilter{MeetingIds: []int64{3, 1, 2}}, ListOptions{}),
+			b:       key(&racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2, 3, 1}}, ListOptions{}),
+			sameKey: true,
+		},
+		{
+			name:    "order_by spelling",
+			a:       key(nil, ListOptions{OrderBy: "advertised_start_time DESC, name"}),
+			b:       key(nil, ListOptions{OrderBy: "advertised_start_time desc,name asc"}),
+			sameKey: true,
+		},
+		{
+			name:    "no filter and an empty one",
+			a:       key(nil, ListOptions{}),
+			b:       key(&racing.ListRacesRequestFilter{}, ListOptions{}),
+			sameKey: true,
+		},
+		{
+			name: "meeting IDs",
+			a:    key(&racing.ListRacesRequestFilter{MeetingIds: []int64{1}}, ListOptions{}),
+			b:    key(&racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}}, ListOptions{}),
+		},
+		{
+			name: "visible unset and false",
+			a:    key(&racing.ListRacesRequestFilter{}, ListOptions{}),
+			b:    key(&racing.ListRacesRequestFilter{Visible: proto.Bool(false)}, ListOptions{}),
+		},
+		{
+			name: "status",
+			a:    key(&racing.ListRacesRequestFilter{Status: racing.Race_OPEN}, ListOptions{}),
+			b:    key(&racing.ListRacesRequestFilter{Status: racing.Race_CLOSED}, ListOptions{}),
+		},
+		{
+			name: "order direction",
+			a:    key(nil, ListOptions{OrderBy: "name"}),
+			b:    key(nil, ListOptions{OrderBy: "name desc"}),
+		},
+		{
+			name: "page size",
+			a:    key(nil, ListOptions{PageSize: 10}),
+			b:    key(nil, ListOptions{PageSize: 20}),
+		},
+		{
+			name: "page",
+			a:    key(nil, ListOptions{PageSize: 10}),
+			b:    key(nil, ListOptions{PageSize: 10, After: &Cursor{LastID: 5}}),
+		},
+	}
+
+	for _, tt := range tests {
+		if same := tt.a == tt.b; same != tt.sameKey {
+			t.Errorf("%s: keys %s and %s same = %v, want %v", tt.name, tt.a, tt.b, same, tt.sameKey)
+		}
+	}
+
+	if _, err := listCacheKey(nil, ListOptions{OrderBy: "unknown"}); err == nil {
+		t.Error("key of an unknown order_by term made, want an error")
+	}
+}
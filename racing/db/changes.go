@@ -0,0 +1,180 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+const (
+	// subscriptionBuffer is how many changes a subscriber may fall behind by
+	// before it is dropped from the feed.
+	subscriptionBuffer = 256
+
+	// feedHistory is how many recent changes are kept for replaying to
+	// subscribers which are resuming.
+	feedHistory = 1024
+)
+
+// ChangeType describes what happened to a race.
+type ChangeType int
+
+const (
+	// ChangeCreated is published when a race is created.
+	ChangeCreated ChangeType = iota + 1
+
+	// ChangeUpdated is published when a race is modified.
+	ChangeUpdated
+
+	// ChangeClosed is published when a race's advertised start time passes,
+	// and its status transitions to CLOSED.
+	ChangeClosed
+
+	// ChangeDeleted is published when a race is deleted. The race holds its
+	// state prior to deletion.
+	ChangeDeleted
+)
+
+// Change is a single entry in the race change feed.
+type Change struct {
+	// Seq is the position of the change in the feed, increasing by one with
+	// every change published.
+	Seq uint64
+
+	// Type describes what happened to the race.
+	Type ChangeType
+
+	// Race is the state of the race following the change. It must not be
+	// modified, as it is shared between subscribers.
+	Race *racing.Race
+
+	// Previous is the state of the race before the change, so subscribers
+	// can tell when it stops matching what they're interested in. It's nil
+	// for created and deleted races, and must not be modified either.
+	Previous *racing.Race
+}
+
+// changeFeed fans changes out to subscribers. Publishing never blocks: a
+// subscriber which falls too far behind is dropped instead, so one stalled
+// consumer can't hold up writers.
+type changeFeed struct {
+	mu      sync.Mutex
+	seq     uint64
+	subs    map[*Subscription]struct{}
+	history []Change
+}
+
+// newChangeFeed creates a change feed. Sequences start from the creation
+// time in nanoseconds, so they keep increasing across restarts and a client
+// can't mistakenly resume from a sequence issued by a previous process.
+func newChangeFeed(now time.Time) *changeFeed {
+	return &changeFeed{seq: uint64(now.UnixNano())}
+}
+
+// Subscription receives changes published after it was created.
+type Subscription struct {
+	feed   *changeFeed
+	c      chan Change
+	seq    uint64
+	replay []Change
+	resume bool
+
+	// dropped is set, under the feed's lock, when the subscriber fell behind.
+	dropped bool
+}
+
+// Seq returns the sequence of the last change published before the
+// subscription was created.
+func (s *Subscription) Seq() uint64 {
+	return s.seq
+}
+
+// Resumed reports whether the subscription picked up from the sequence it
+// was asked to resume after. If so, Replay holds the changes missed since.
+func (s *Subscription) Resumed() bool {
+	return s.resume
+}
+
+// Replay returns the changes published between the sequence the
+// subscription resumed after and its creation, oldest first.
+func (s *Subscription) Replay() []Change {
+	return s.replay
+}
+
+// C returns the channel changes are delivered on. It is closed when the
+// subscription is closed, or dropped for falling behind.
+func (s *Subscription) C() <-chan Change {
+	return s.c
+}
+
+// Dropped reports whether the subscription was closed by the feed because
+// the subscriber fell behind. It is only meaningful once C is closed.
+func (s *Subscription) Dropped() bool {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+
+	return s.dropped
+}
+
+// Close unsubscribes from the feed. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+
+	if _, ok := s.feed.subs[s]; ok {
+		delete(s.feed.subs, s)
+		close(s.c)
+	}
+}
+
+// subscribe registers a new subscriber. When after is non-zero, the
+// subscriber resumes from that sequence if the feed's history still holds
+// every change since.
+func (f *changeFeed) subscribe(after uint64) *Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.subs == nil {
+		f.subs = make(map[*Subscription]struct{})
+	}
+
+	sub := &Subscription{feed: f, c: make(chan Change, subscriptionBuffer), seq: f.seq}
+	f.subs[sub] = struct{}{}
+
+	if after != 0 && after <= f.seq {
+		oldest := f.seq - uint64(len(f.history))
+		if after >= oldest {
+			sub.resume = true
+			sub.replay = append([]Change(nil), f.history[len(f.history)-int(f.seq-after):]...)
+		}
+	}
+
+	return sub
+}
+
+// publish delivers a change to every subscriber, dropping those whose
+// buffers are full. previous is the race's state before the change, if it
+// was updated or closed.
+func (f *changeFeed) publish(changeType ChangeType, previous, race *racing.Race) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.seq++
+	change := Change{Seq: f.seq, Type: changeType, Race: race, Previous: previous}
+
+	f.history = append(f.history, change)
+	if len(f.history) > feedHistory {
+		f.history = f.history[len(f.history)-feedHistory:]
+	}
+
+	for sub := range f.subs {
+		select {
+		case sub.c <- change:
+		default:
+			sub.dropped = true
+			delete(f.subs, sub)
+			close(sub.c)
+		}
+	}
+}
@@ -1,30 +1,316 @@
 package db
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"gopkg.in/yaml.v3"
 	"syreclabs.com/go/faker"
 )
 
-func (r *racesRepo) seed() error {
-	statement, err := r.db.Prepare(`CREATE TABLE IF NOT EXISTS races (id INTEGER PRIMARY KEY, meeting_id INTEGER, name TEXT, number INTEGER, visible INTEGER, advertised_start_time DATETIME)`)
-	if err == nil {
-		_, err = statement.Exec()
+// Fixtures is a complete set of meetings, races and runners to seed the
+// database with. They can be generated, or loaded from a JSON or YAML file
+// to reproduce an exact race card.
+type Fixtures struct {
+	Meetings []MeetingFixture `json:"meetings" yaml:"meetings"`
+	Races    []RaceFixture    `json:"races" yaml:"races"`
+	Runners  []RunnerFixture  `json:"runners" yaml:"runners"`
+}
+
+// MeetingFixture is a meeting to seed.
+type MeetingFixture struct {
+	ID      int64  `json:"id" yaml:"id"`
+	Venue   string `json:"venue" yaml:"venue"`
+	Country string `json:"country" yaml:"country"`
+
+	// RaceType is the name of a Meeting.RaceType, e.g. THOROUGHBRED.
+	RaceType string `json:"race_type" yaml:"race_type"`
+
+	// Date is the day the meeting is held on, as YYYY-MM-DD.
+	Date string `json:"date" yaml:"date"`
+}
+
+// meeting converts the fixture into a Meeting, checking its race type and
+// date are valid.
+func (f MeetingFixture) meeting() (*racing.Meeting, error) {
+	raceType, ok := racing.Meeting_RaceType_value[f.RaceType]
+	if !ok {
+		return nil, fmt.Errorf("meeting %d has unknown race type %q", f.ID, f.RaceType)
+	}
+
+	if _, err := time.Parse(meetingDateLayout, f.Date); err != nil {
+		return nil, fmt.Errorf("meeting %d has invalid date %q", f.ID, f.Date)
+	}
+
+	return &racing.Meeting{
+		Id:       f.ID,
+		Venue:    f.Venue,
+		Country:  f.Country,
+		RaceType: racing.Meeting_RaceType(raceType),
+		Date:     f.Date,
+	}, nil
+}
+
+// RaceFixture is a race to seed.
+type RaceFixture struct {
+	ID                  int64     `json:"id" yaml:"id"`
+	MeetingID           int64     `json:"meeting_id" yaml:"meeting_id"`
+	Name                string    `json:"name" yaml:"name"`
+	Number              int64     `json:"number" yaml:"number"`
+	Visible             bool      `json:"visible" yaml:"visible"`
+	AdvertisedStartTime time.Time `json:"advertised_start_time" yaml:"advertised_start_time"`
+}
+
+// RunnerFixture is a runner to seed.
+type RunnerFixture struct {
+	ID                int64   `json:"id" yaml:"id"`
+	RaceID            int64   `json:"race_id" yaml:"race_id"`
+	Barrier           int64   `json:"barrier" yaml:"barrier"`
+	SaddleClothNumber int64   `json:"saddle_cloth_number" yaml:"saddle_cloth_number"`
+	Name              string  `json:"name" yaml:"name"`
+	Jockey            string  `json:"jockey" yaml:"jockey"`
+	Trainer           string  `json:"trainer" yaml:"trainer"`
+	Weight            float64 `json:"weight" yaml:"weight"`
+	Scratched         bool    `json:"scratched" yaml:"scratched"`
+}
+
+// seedVenue describes a track which seeded meetings are held at.
+type seedVenue struct {
+	name     string
+	country  string
+	raceType racing.Meeting_RaceType
+}
+
+// seedVenues are the venues of the seeded meetings, one meeting per venue.
+// Seeded races reference these meetings by ID, so both tables stay consistent.
+var seedVenues = []seedVenue{
+	{"Flemington", "AU", racing.Meeting_THOROUGHBRED},
+	{"Randwick", "AU", racing.Meeting_THOROUGHBRED},
+	{"Eagle Farm", "AU", racing.Meeting_THOROUGHBRED},
+	{"Ellerslie", "NZ", racing.Meeting_THOROUGHBRED},
+	{"Ascot", "GB", racing.Meeting_THOROUGHBRED},
+	{"Menangle", "AU", racing.Meeting_HARNESS},
+	{"Addington", "NZ", racing.Meeting_HARNESS},
+	{"Melton", "AU", racing.Meeting_HARNESS},
+	{"Wentworth Park", "AU", racing.Meeting_GREYHOUND},
+	{"The Meadows", "AU", racing.Meeting_GREYHOUND},
+}
+
+const (
+	// seedRaces is how many races are generated.
+	seedRaces = 100
+
+	// maxSeedRunners is the most runners generated for a single race.
+	maxSeedRunners = 12
+)
+
+// GenerateFixtures returns random fixtures. The same seed value and day
+// always generate the same fixtures, with meetings held from the day before
+// day until the day after, and each race starting on its meeting's date.
+func GenerateFixtures(seed int64, day time.Time) *Fixtures {
+	faker.Seed(seed)
+
+	// Times are generated to the second, with both bounds inclusive.
+	day = day.UTC().Truncate(24 * time.Hour)
+	from, until := day.AddDate(0, 0, -1), day.AddDate(0, 0, 2).Add(-time.Second)
+
+	fixtures := &Fixtures{}
+	meetingDates := make([]time.Time, len(seedVenues))
+
+	for i, venue := range seedVenues {
+		meetingDates[i] = faker.Time().Between(from, until).UTC().Truncate(24 * time.Hour)
+
+		fixtures.Meetings = append(fixtures.Meetings, MeetingFixture{
+			ID:       int64(i + 1),
+			Venue:    venue.name,
+			Country:  venue.country,
+			RaceType: venue.raceType.String(),
+			Date:     meetingDates[i].Format(meetingDateLayout),
+		})
+	}
+
+	for id := int64(1); id <= seedRaces; id++ {
+		meetingID := faker.RandomInt(1, len(seedVenues))
+		date := meetingDates[meetingID-1]
+
+		fixtures.Races = append(fixtures.Races, RaceFixture{
+			ID:                  id,
+			MeetingID:           int64(meetingID),
+			Name:                faker.Team().Name(),
+			Number:              int64(faker.RandomInt(1, 12)),
+			Visible:             faker.RandomInt(0, 1) == 1,
+			AdvertisedStartTime: faker.Time().Between(date, date.Add(24*time.Hour-time.Second)).UTC(),
+		})
+
+		fixtures.Runners = append(fixtures.Runners, generateRunners(id, seedVenues[meetingID-1].raceType)...)
+	}
+
+	return fixtures
+}
+
+// generateRunners returns random runners for a race. Jockeys and weights
+// are only set where the race type has them.
+func generateRunners(raceID int64, raceType racing.Meeting_RaceType) []RunnerFixture {
+	count := faker.RandomInt(6, maxSeedRunners)
+	barriers := faker.RandomInt(0, count-1)
+
+	runners := make([]RunnerFixture, 0, count)
+	for n := 1; n <= count; n++ {
+		runner := RunnerFixture{
+			// IDs are derived from the race, so re-seeding doesn't duplicate runners.
+			ID:                (raceID-1)*maxSeedRunners + int64(n),
+			RaceID:            raceID,
+			Barrier:           int64((n+barriers)%count + 1),
+			SaddleClothNumber: int64(n),
+			Name:              strings.Title(strings.Join(faker.Lorem().Words(2), " ")),
+			Trainer:           faker.Name().Name(),
+			Scratched:         faker.RandomInt(0, 9) == 0,
+		}
+
+		if raceType != racing.Meeting_GREYHOUND {
+			runner.Jockey = faker.Name().Name()
+		}
+		if raceType == racing.Meeting_THOROUGHBRED {
+			runner.Weight = float64(faker.RandomInt(108, 124)) / 2
+		}
+
+		runners = append(runners, runner)
+	}
+
+	return runners
+}
+
+// LoadFixtures reads fixtures from a JSON or YAML file, by its extension.
+func LoadFixtures(path string) (*Fixtures, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := &Fixtures{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		err = json.Unmarshal(data, fixtures)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, fixtures)
+	default:
+		return nil, fmt.Errorf("unsupported fixtures file extension %q, expected .json, .yaml or .yml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing fixtures %s: %w", path, err)
+	}
+
+	if err := fixtures.checkReferences(); err != nil {
+		return nil, fmt.Errorf("invalid fixtures %s: %w", path, err)
+	}
+
+	return fixtures, nil
+}
+
+// checkReferences returns an error naming the first race whose meeting, or
+// runner whose race, isn't among the fixtures.
+func (f *Fixtures) checkReferences() error {
+	meetings := make(map[int64]bool, len(f.Meetings))
+	for _, meeting := range f.Meetings {
+		meetings[meeting.ID] = true
+	}
+
+	races := make(map[int64]bool, len(f.Races))
+	for _, race := range f.Races {
+		if !meetings[race.MeetingID] {
+			return fmt.Errorf("race %d references meeting %d, which isn't in the fixtures", race.ID, race.MeetingID)
+		}
+
+		races[race.ID] = true
+	}
+
+	for _, runner := range f.Runners {
+		if !races[runner.RaceID] {
+			return fmt.Errorf("runner %d references race %d, which isn't in the fixtures", runner.ID, runner.RaceID)
+		}
+	}
+
+	return nil
+}
+
+// Seed inserts fixtures into the database in a single transaction. Rows
+// which already exist are left untouched, so seeding is safe to repeat.
+func Seed(db *DB, fixtures *Fixtures) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	meetings, err := tx.Prepare(`INSERT INTO meetings(id, venue, country, race_type, date) VALUES (?,?,?,?,?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer meetings.Close()
+
+	for _, fixture := range fixtures.Meetings {
+		meeting, err := fixture.meeting()
+		if err != nil {
+			return err
+		}
+
+		if _, err := meetings.Exec(meeting.Id, meeting.Venue, meeting.Country, int32(meeting.RaceType), meeting.Date); err != nil {
+			return err
+		}
+	}
+
+	races, err := tx.Prepare(`INSERT INTO races(id, meeting_id, name, number, visible, advertised_start_time) VALUES (?,?,?,?,?,?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer races.Close()
+
+	for _, race := range fixtures.Races {
+		if _, err := races.Exec(
+			race.ID,
+			race.MeetingID,
+			race.Name,
+			race.Number,
+			race.Visible,
+			race.AdvertisedStartTime.UTC().Format(time.RFC3339),
+		); err != nil {
+			return err
+		}
+	}
+
+	runners, err := tx.Prepare(`INSERT INTO runners(id, race_id, barrier, saddle_cloth_number, name, jockey, trainer, weight, scratched) VALUES (?,?,?,?,?,?,?,?,?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer runners.Close()
+
+	for _, runner := range fixtures.Runners {
+		if _, err := runners.Exec(
+			runner.ID,
+			runner.RaceID,
+			runner.Barrier,
+			runner.SaddleClothNumber,
+			runner.Name,
+			runner.Jockey,
+			runner.Trainer,
+			runner.Weight,
+			runner.Scratched,
+		); err != nil {
+			return err
+		}
 	}
 
-	for i := 1; i <= 100; i++ {
-		statement, err = r.db.Prepare(`INSERT OR IGNORE INTO races(id, meeting_id, name, number, visible, advertised_start_time) VALUES (?,?,?,?,?,?)`)
-		if err == nil {
-			_, err = statement.Exec(
-				i,
-				faker.Number().Between(1, 10),
-				faker.Team().Name(),
-				faker.Number().Between(1, 12),
-				faker.Number().Between(0, 1),
-				faker.Time().Between(time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 2)).Format(time.RFC3339),
-			)
+	if db.Dialect.syncSequences != "" {
+		if _, err := tx.Exec(db.Dialect.syncSequences); err != nil {
+			return err
 		}
 	}
 
-	return err
+	return tx.Commit()
 }
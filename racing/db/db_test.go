@@ -0,0 +1,140 @@
+package db_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+)
+
+func TestGenerateFixtures(t *testing.T) {
+	day := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	fixtures := db.GenerateFixtures(42, day)
+
+	// The card depends only on the seed value and the day, not the time of
+	// day it's generated at.
+	if again := db.GenerateFixtures(42, day.Add(23*time.Hour)); !reflect.DeepEqual(again, fixtures) {
+		t.Error("generated different fixtures later the same day")
+	}
+	if other := db.GenerateFixtures(43, day); reflect.DeepEqual(other, fixtures) {
+		t.Error("generated the same fixtures from another seed value")
+	}
+
+	meetingDates := make(map[int64]string)
+	for _, meeting := range fixtures.Meetings {
+		if meeting.Date < "2029-12-31" || meeting.Date > "2030-01-02" {
+			t.Errorf("meeting %d held on %s, want from the day before until the day after 2030-01-01", meeting.ID, meeting.Date)
+		}
+
+		meetingDates[meeting.ID] = meeting.Date
+	}
+
+	raceIDs := make(map[int64]bool)
+	for _, race := range fixtures.Races {
+		date, ok := meetingDates[race.MeetingID]
+		if !ok {
+			t.Fatalf("race %d references missing meeting %d", race.ID, race.MeetingID)
+		}
+
+		if start := race.AdvertisedStartTime.UTC().Format("2006-01-02"); start != date {
+			t.Errorf("race %d starts on %s, but its meeting %d is on %s", race.ID, start, race.MeetingID, date)
+		}
+
+		raceIDs[race.ID] = true
+	}
+
+	for _, runner := range fixtures.Runners {
+		if !raceIDs[runner.RaceID] {
+			t.Fatalf("runner %d references missing race %d", runner.ID, runner.RaceID)
+		}
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	const meetings = `
+meetings:
+  - {id: 1, venue: Flemington, country: AU, race_type: THOROUGHBRED, date: "2030-01-01"}
+`
+
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		err      string
+	}{
+		{
+			name: "valid",
+			file: "card.yaml",
+			contents: meetings + `
+races:
+  - {id: 1, meeting_id: 1, name: Alpha, number: 1, advertised_start_time: "2030-01-01T03:00:00Z"}
+runners:
+  - {id: 1, race_id: 1, barrier: 1, saddle_cloth_number: 1, name: Gold Trip}
+`,
+		},
+		{
+			name:     "valid JSON",
+			file:     "card.json",
+			contents: `{"meetings": [{"id": 1, "race_type": "HARNESS", "date": "2030-01-01"}], "races": [{"id": 1, "meeting_id": 1}]}`,
+		},
+		{
+			name: "race of a missing meeting",
+			file: "card.yaml",
+			contents: meetings + `
+races:
+  - {id: 1, meeting_id: 1, name: Alpha, number: 1}
+  - {id: 2, meeting_id: 9, name: Bravo, number: 2}
+`,
+			err: "race 2 references meeting 9",
+		},
+		{
+			name: "runner of a missing race",
+			file: "card.yaml",
+			contents: meetings + `
+races:
+  - {id: 1, meeting_id: 1, name: Alpha, number: 1}
+runners:
+  - {id: 1, race_id: 1, name: Gold Trip}
+  - {id: 7, race_id: 3, name: Winx}
+`,
+			err: "runner 7 references race 3",
+		},
+		{
+			name:     "malformed",
+			file:     "card.yaml",
+			contents: "races: [",
+			err:      "failed parsing fixtures",
+		},
+		{
+			name:     "unsupported extension",
+			file:     "card.txt",
+			contents: meetings,
+			err:      "unsupported fixtures file extension",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := db.LoadFixtures(path)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("LoadFixtures: %s", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("loaded fixtures, want an error containing %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Errorf("error = %q, want it to contain %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Package dbtest holds a conformance suite for RacesRepo implementations, so
+// that every storage backend can be held to the same filtering, ordering,
+// paging and concurrency semantics. Call it from a test of the backend:
+//
+//	func TestSQLiteRacesRepo(t *testing.T) {
+//		dbtest.TestRacesRepo(t, dbtest.SQLRacesRepo(dbtest.SQLite(t)))
+//	}
+package dbtest
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+)
+
+// PostgresDSNEnv names the environment variable holding the DSN of a
+// Postgres database to run against, rather than starting an embedded one.
+// The database is wiped by every test, so must be disposable.
+const PostgresDSNEnv = "RACING_TEST_POSTGRES_DSN"
+
+// NewRacesRepo creates a races repository holding only fixtures, whose clock
+// reads now.
+type NewRacesRepo func(t *testing.T, fixtures *db.Fixtures, now func() time.Time) db.RacesRepo
+
+// SQLite opens a database in a temporary file, removed once the test ends.
+func SQLite(t *testing.T) *db.DB {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "racing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return open(t, db.SQLite.Driver, filepath.Join(dir, "racing.db"))
+}
+
+// Postgres opens the database named by PostgresDSNEnv or, failing that,
+// starts an embedded Postgres server for the duration of the test. The test
+// is skipped if no server can be started, e.g. because its binaries can't
+// be downloaded, except under CI, where it fails instead.
+//
+// Sessions run in a time zone other than UTC, so that times which are only
+// correct in UTC show up.
+func Postgres(t *testing.T) *db.DB {
+	t.Helper()
+
+	t.Setenv("PGTZ", "Australia/Melbourne")
+
+	if dsn := os.Getenv(PostgresDSNEnv); dsn != "" {
+		return open(t, db.Postgres.Driver, dsn)
+	}
+
+	if testing.Short() {
+		t.Skip("skipping embedded postgres in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "racing-postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	config := embeddedpostgres.DefaultConfig().
+		Port(freePort(t)).
+		RuntimePath(filepath.Join(dir, "runtime")).
+		Logger(ioutil.Discard)
+
+	server := embeddedpostgres.NewDatabase(config)
+	if err := server.Start(); err != nil {
+		if os.Getenv("CI") != "" {
+			t.Fatalf("embedded postgres unavailable, and %s unset: %s", PostgresDSNEnv, err)
+		}
+
+		t.Skipf("skipping, embedded postgres unavailable: %s", err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	return open(t, db.Postgres.Driver, config.GetConnectionURL()+"?sslmode=disable")
+}
+
+// SQLRacesRepo returns a NewRacesRepo for races stored in database. The
+// database is wiped, migrated and seeded with the fixtures for every repo.
+func SQLRacesRepo(database *db.DB) NewRacesRepo {
+	return func(t *testing.T, fixtures *db.Fixtures, now func() time.Time) db.RacesRepo {
+		t.Helper()
+
+		for _, table := range []string{"runners", "races", "meetings", "schema_migrations"} {
+			if _, err := database.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+				t.Fatalf("failed dropping %s: %s", table, err)
+			}
+		}
+
+		if err := db.NewMigrator(database).Up(); err != nil {
+			t.Fatalf("failed migrating: %s", err)
+		}
+
+		if err := db.Seed(database, fixtures); err != nil {
+			t.Fatalf("failed seeding: %s", err)
+		}
+
+		return db.NewRacesRepo(database, now)
+	}
+}
+
+// MemoryRacesRepo is a NewRacesRepo for races held in a fresh MemoryDB.
+func MemoryRacesRepo(t *testing.T, fixtures *db.Fixtures, now func() time.Time) db.RacesRepo {
+	t.Helper()
+
+	mem := db.NewMemoryDB()
+	if err := mem.Seed(fixtures); err != nil {
+		t.Fatalf("failed seeding: %s", err)
+	}
+
+	return db.NewMemoryRacesRepo(mem, now)
+}
+
+func open(t *testing.T, driver, dsn string) *db.DB {
+	t.Helper()
+
+	database, err := db.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	if err := database.Ping(); err != nil {
+		t.Fatalf("failed connecting to %s: %s", driver, err)
+	}
+
+	return database
+}
+
+// freePort returns a TCP port nothing is currently listening on.
+func freePort(t *testing.T) uint32 {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return uint32(l.Addr().(*net.TCPAddr).Port)
+}
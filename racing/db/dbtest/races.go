@@ -0,0 +1,510 @@
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// now is the time the suite's repositories are created at.
+var now = time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// fixtures returns the races the suite runs against. Races 1 and 2 have
+// started, and races 3 and 4 share a start time, so ordering by it falls
+// back to their IDs.
+func fixtures() *db.Fixtures {
+	return &db.Fixtures{
+		Meetings: []db.MeetingFixture{
+			{ID: 1, Venue: "Flemington", Country: "AU", RaceType: "THOROUGHBRED", Date: "2030-01-01"},
+			{ID: 2, Venue: "Menangle", Country: "AU", RaceType: "HARNESS", Date: "2030-01-01"},
+		},
+		Races: []db.RaceFixture{
+			{ID: 1, MeetingID: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: now.Add(-2 * time.Hour)},
+			{ID: 2, MeetingID: 1, Name: "Bravo", Number: 2, Visible: false, AdvertisedStartTime: now.Add(-time.Hour)},
+			{ID: 3, MeetingID: 2, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: now.Add(time.Hour)},
+			{ID: 4, MeetingID: 2, Name: "Charlie", Number: 2, Visible: true, AdvertisedStartTime: now.Add(time.Hour)},
+			{ID: 5, MeetingID: 1, Name: "Delta", Number: 3, Visible: false, AdvertisedStartTime: now.Add(2 * time.Hour)},
+			{ID: 6, MeetingID: 2, Name: "Echo", Number: 3, Visible: true, AdvertisedStartTime: now.Add(3 * time.Hour)},
+		},
+		Runners: []db.RunnerFixture{
+			{ID: 1, RaceID: 1, Barrier: 1, SaddleClothNumber: 1, Name: "Gold Trip"},
+			{ID: 2, RaceID: 1, Barrier: 2, SaddleClothNumber: 2, Name: "Verry Elleegant"},
+		},
+	}
+}
+
+// TestRacesRepo runs the conformance suite against repositories created by
+// newRepo. Each subtest gets a fresh repository.
+func TestRacesRepo(t *testing.T, newRepo NewRacesRepo) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, repo db.RacesRepo)
+	}{
+		{"Get", testGet},
+		{"ListFilter", testListFilter},
+		{"ListOrder", testListOrder},
+		{"ListPages", testListPages},
+		{"Create", testCreate},
+		{"Update", testUpdate},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+		{"Delete", testDelete},
+		{"Subscribe", testSubscribe},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			clock := func() time.Time { return now }
+			tt.test(t, newRepo(t, fixtures(), clock))
+		})
+	}
+}
+
+func testGet(t *testing.T, repo db.RacesRepo) {
+	race, err := repo.Get(3)
+	if err != nil {
+		t.Fatalf("Get(3): %s", err)
+	}
+
+	want := &racing.Race{
+		Id:                  3,
+		MeetingId:           2,
+		Name:                "Alpha",
+		Number:              1,
+		Visible:             true,
+		AdvertisedStartTime: timestamppb.New(now.Add(time.Hour)),
+		Status:              racing.Race_OPEN,
+	}
+	if race.Etag == "" {
+		t.Errorf("Get(3) has no etag")
+	}
+	race.Etag = ""
+	assertRace(t, race, want)
+
+	race, err = repo.Get(1)
+	if err != nil {
+		t.Fatalf("Get(1): %s", err)
+	}
+	if race.Status != racing.Race_CLOSED {
+		t.Errorf("Get(1) status = %s, want CLOSED", race.Status)
+	}
+
+	if _, err := repo.Get(99); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get(99) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testListFilter(t *testing.T, repo db.RacesRepo) {
+	visible, hidden := true, false
+
+	tests := []struct {
+		name   string
+		filter *racing.ListRacesRequestFilter
+		want   []int64
+	}{
+		{"none", nil, []int64{1, 2, 3, 4, 5, 6}},
+		{"empty", &racing.ListRacesRequestFilter{}, []int64{1, 2, 3, 4, 5, 6}},
+		{"meeting", &racing.ListRacesRequestFilter{MeetingIds: []int64{2}}, []int64{3, 4, 6}},
+		{"meetings", &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}}, []int64{1, 2, 3, 4, 5, 6}},
+		{"visible", &racing.ListRacesRequestFilter{Visible: &visible}, []int64{1, 3, 4, 6}},
+		{"hidden", &racing.ListRacesRequestFilter{Visible: &hidden}, []int64{2, 5}},
+		{"open", &racing.ListRacesRequestFilter{Status: racing.Race_OPEN}, []int64{3, 4, 5, 6}},
+		{"closed", &racing.ListRacesRequestFilter{Status: racing.Race_CLOSED}, []int64{1, 2}},
+		{"combined", &racing.ListRacesRequestFilter{MeetingIds: []int64{1}, Status: racing.Race_OPEN}, []int64{5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			races, next, err := repo.List(context.Background(), tt.filter, db.ListOptions{})
+			if err != nil {
+				t.Fatalf("List: %s", err)
+			}
+			if next != nil {
+				t.Errorf("List returned a cursor without a page size")
+			}
+
+			assertIDs(t, races, tt.want)
+
+			for _, race := range races {
+				if !db.MatchesFilter(race, tt.filter) {
+					t.Errorf("race %d doesn't match the filter it was listed by", race.Id)
+				}
+			}
+		})
+	}
+}
+
+func testListOrder(t *testing.T, repo db.RacesRepo) {
+	tests := []struct {
+		orderBy string
+		want    []int64
+	}{
+		{"", []int64{1, 2, 3, 4, 5, 6}},
+		{"advertised_start_time desc", []int64{6, 5, 3, 4, 2, 1}},
+		{"name", []int64{1, 3, 2, 4, 5, 6}},
+		{"name DESC", []int64{6, 5, 4, 2, 1, 3}},
+		{"meeting_id, number desc", []int64{5, 2, 1, 6, 4, 3}},
+		{"visible desc, id desc", []int64{6, 4, 3, 1, 5, 2}},
+		{"id desc", []int64{6, 5, 4, 3, 2, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			races, _, err := repo.List(context.Background(), nil, db.ListOptions{OrderBy: tt.orderBy})
+			if err != nil {
+				t.Fatalf("List: %s", err)
+			}
+
+			assertIDs(t, races, tt.want)
+		})
+	}
+
+	for _, orderBy := range []string{"status", "name sideways", "name,"} {
+		if _, _, err := repo.List(context.Background(), nil, db.ListOptions{OrderBy: orderBy}); !errors.Is(err, db.ErrInvalidArgument) {
+			t.Errorf("List(order_by %q) error = %v, want ErrInvalidArgument", orderBy, err)
+		}
+	}
+}
+
+func testListPages(t *testing.T, repo db.RacesRepo) {
+	visible := true
+
+	for _, orderBy := range []string{"", "advertised_start_time desc", "name", "name desc, number", "visible, meeting_id desc"} {
+		for _, filter := range []*racing.ListRacesRequestFilter{nil, {Visible: &visible}} {
+			all, _, err := repo.List(context.Background(), filter, db.ListOptions{OrderBy: orderBy})
+			if err != nil {
+				t.Fatalf("List(order_by %q): %s", orderBy, err)
+			}
+
+			var (
+				paged []*racing.Race
+				after *db.Cursor
+			)
+
+			for page := 0; ; page++ {
+				if page > len(all) {
+					t.Fatalf("order_by %q: paging didn't finish", orderBy)
+				}
+
+				races, next, err := repo.List(context.Background(), filter, db.ListOptions{OrderBy: orderBy, PageSize: 2, After: after})
+				if err != nil {
+					t.Fatalf("order_by %q: List page %d: %s", orderBy, page, err)
+				}
+				if len(races) > 2 {
+					t.Fatalf("order_by %q: page %d has %d races, want at most 2", orderBy, page, len(races))
+				}
+
+				paged = append(paged, races...)
+				if next == nil {
+					break
+				}
+
+				// Cursors reach clients inside page tokens, as JSON.
+				after = roundTrip(t, next)
+			}
+
+			if !reflect.DeepEqual(ids(paged), ids(all)) {
+				t.Errorf("order_by %q, filter %v: paged %v, want %v", orderBy, filter, ids(paged), ids(all))
+			}
+		}
+	}
+}
+
+func testCreate(t *testing.T, repo db.RacesRepo) {
+	sub := repo.Subscribe(0)
+	defer sub.Close()
+
+	start := now.Add(4 * time.Hour)
+	created, err := repo.Create(&racing.Race{
+		MeetingId:           2,
+		Name:                "Foxtrot",
+		Number:              4,
+		Visible:             true,
+		AdvertisedStartTime: timestamppb.New(start),
+	})
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+
+	if created.Id <= 6 {
+		t.Errorf("Create assigned ID %d, which clashes with the fixtures", created.Id)
+	}
+	if created.Etag == "" {
+		t.Errorf("Create returned no etag")
+	}
+
+	got, err := repo.Get(created.Id)
+	if err != nil {
+		t.Fatalf("Get(%d): %s", created.Id, err)
+	}
+
+	assertRace(t, got, &racing.Race{
+		Id:                  created.Id,
+		MeetingId:           2,
+		Name:                "Foxtrot",
+		Number:              4,
+		Visible:             true,
+		AdvertisedStartTime: timestamppb.New(start),
+		Status:              racing.Race_OPEN,
+		Etag:                created.Etag,
+	})
+
+	assertChange(t, sub, db.ChangeCreated, created.Id)
+}
+
+func testUpdate(t *testing.T, repo db.RacesRepo) {
+	sub := repo.Subscribe(0)
+	defer sub.Close()
+
+	original, err := repo.Get(3)
+	if err != nil {
+		t.Fatalf("Get(3): %s", err)
+	}
+
+	updated, err := repo.Update(&racing.Race{Id: 3, Name: "Golf", Number: 9, Etag: original.Etag}, []string{"name"})
+	if err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	if updated.Etag == original.Etag {
+		t.Errorf("Update didn't change the etag %q", updated.Etag)
+	}
+
+	want := proto.Clone(original).(*racing.Race)
+	want.Name = "Golf"
+	want.Etag = updated.Etag
+	assertRace(t, updated, want)
+
+	assertChange(t, sub, db.ChangeUpdated, 3)
+
+	for _, etag := range []string{original.Etag, "stale"} {
+		if _, err := repo.Update(&racing.Race{Id: 3, Name: "Hotel", Etag: etag}, []string{"name"}); !errors.Is(err, db.ErrEtagMismatch) {
+			t.Errorf("Update(etag %q) error = %v, want ErrEtagMismatch", etag, err)
+		}
+	}
+
+	// The etag is checked even when there's nothing to write.
+	if _, err := repo.Update(&racing.Race{Id: 3, Etag: original.Etag}, nil); !errors.Is(err, db.ErrEtagMismatch) {
+		t.Errorf("Update(no fields, stale etag) error = %v, want ErrEtagMismatch", err)
+	}
+	if got, err := repo.Update(&racing.Race{Id: 3, Etag: updated.Etag}, nil); err != nil || got.Etag != updated.Etag {
+		t.Errorf("Update(no fields, current etag) = %v, %v, want the race unchanged", got, err)
+	}
+
+	// Without an etag, updates are unconditional.
+	if _, err := repo.Update(&racing.Race{Id: 3, Visible: false}, []string{"visible"}); err != nil {
+		t.Errorf("Update without etag: %s", err)
+	}
+
+	if _, err := repo.Update(&racing.Race{Id: 99, Name: "India"}, []string{"name"}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Update(99) error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := repo.Update(&racing.Race{Id: 3}, []string{"status"}); !errors.Is(err, db.ErrInvalidArgument) {
+		t.Errorf("Update(status) error = %v, want ErrInvalidArgument", err)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, repo db.RacesRepo) {
+	const writers = 8
+
+	original, err := repo.Get(4)
+	if err != nil {
+		t.Fatalf("Get(4): %s", err)
+	}
+
+	// update makes writers concurrent updates of race 4's name, with etag,
+	// returning their errors.
+	update := func(etag string) []error {
+		var wg sync.WaitGroup
+		errs := make([]error, writers)
+
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = repo.Update(&racing.Race{Id: 4, Name: fmt.Sprint("Writer ", i), Etag: etag}, []string{"name"})
+			}(i)
+		}
+
+		wg.Wait()
+
+		return errs
+	}
+
+	// Only one of the writers holding the same etag wins.
+	var won int
+	for _, err := range update(original.Etag) {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, db.ErrEtagMismatch):
+			t.Errorf("Update(etag %q) error = %v, want ErrEtagMismatch", original.Etag, err)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d of %d updates with etag %q succeeded, want 1", won, writers, original.Etag)
+	}
+
+	sub := repo.Subscribe(0)
+	defer sub.Close()
+
+	for _, err := range update("") {
+		if err != nil {
+			t.Errorf("Update without etag: %s", err)
+		}
+	}
+
+	// Each change follows on from the last, so watchers are never told of
+	// a previous state which was already overwritten.
+	var last *racing.Race
+	for i := 0; i < writers; i++ {
+		select {
+		case change := <-sub.C():
+			if last != nil && change.Previous.Etag != last.Etag {
+				t.Errorf("change %d follows etag %q, want %q", i, change.Previous.Etag, last.Etag)
+			}
+			if change.Race.Etag == change.Previous.Etag {
+				t.Errorf("change %d left the etag at %q", i, change.Race.Etag)
+			}
+			last = change.Race
+		case <-time.After(time.Second):
+			t.Fatalf("%d changes published, want %d", i, writers)
+		}
+	}
+
+	current, err := repo.Get(4)
+	if err != nil {
+		t.Fatalf("Get(4): %s", err)
+	}
+	if !proto.Equal(current, last) {
+		t.Errorf("race = %v, want the last change published %v", current, last)
+	}
+}
+
+func testDelete(t *testing.T, repo db.RacesRepo) {
+	sub := repo.Subscribe(0)
+	defer sub.Close()
+
+	race, err := repo.Get(1)
+	if err != nil {
+		t.Fatalf("Get(1): %s", err)
+	}
+
+	if err := repo.Delete(1, "stale"); !errors.Is(err, db.ErrEtagMismatch) {
+		t.Errorf("Delete(stale etag) error = %v, want ErrEtagMismatch", err)
+	}
+	if _, err := repo.Get(1); err != nil {
+		t.Fatalf("race deleted despite a stale etag: %v", err)
+	}
+
+	if err := repo.Delete(1, race.Etag); err != nil {
+		t.Fatalf("Delete(1): %s", err)
+	}
+
+	assertChange(t, sub, db.ChangeDeleted, 1)
+
+	if _, err := repo.Get(1); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Get(1) after Delete error = %v, want ErrNotFound", err)
+	}
+
+	if err := repo.Delete(1, ""); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Delete(1) again error = %v, want ErrNotFound", err)
+	}
+}
+
+func testSubscribe(t *testing.T, repo db.RacesRepo) {
+	first := repo.Subscribe(0)
+	defer first.Close()
+
+	if first.Resumed() {
+		t.Errorf("Subscribe(0) resumed")
+	}
+
+	if _, err := repo.Update(&racing.Race{Id: 2, Name: "Kilo"}, []string{"name"}); err != nil {
+		t.Fatalf("Update: %s", err)
+	}
+
+	second := repo.Subscribe(first.Seq())
+	defer second.Close()
+
+	if !second.Resumed() {
+		t.Fatalf("Subscribe(%d) didn't resume", first.Seq())
+	}
+	if replay := second.Replay(); len(replay) != 1 || replay[0].Race.Id != 2 {
+		t.Errorf("Subscribe(%d) replayed %v, want the update to race 2", first.Seq(), replay)
+	}
+
+	assertChange(t, first, db.ChangeUpdated, 2)
+}
+
+func assertRace(t *testing.T, got, want *racing.Race) {
+	t.Helper()
+
+	if !got.AdvertisedStartTime.AsTime().Equal(want.AdvertisedStartTime.AsTime()) {
+		t.Errorf("race %d advertised_start_time = %s, want %s", got.Id, got.AdvertisedStartTime.AsTime(), want.AdvertisedStartTime.AsTime())
+	}
+
+	g := proto.Clone(got).(*racing.Race)
+	g.AdvertisedStartTime = want.AdvertisedStartTime
+
+	if !proto.Equal(g, want) {
+		t.Errorf("race = %v, want %v", got, want)
+	}
+}
+
+func assertChange(t *testing.T, sub *db.Subscription, changeType db.ChangeType, raceID int64) {
+	t.Helper()
+
+	select {
+	case change := <-sub.C():
+		if change.Type != changeType || change.Race.Id != raceID {
+			t.Errorf("change = %v of race %d, want %v of race %d", change.Type, change.Race.Id, changeType, raceID)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no change published, want %v of race %d", changeType, raceID)
+	}
+}
+
+func assertIDs(t *testing.T, races []*racing.Race, want []int64) {
+	t.Helper()
+
+	if got := ids(races); !reflect.DeepEqual(got, want) {
+		t.Errorf("race IDs = %v, want %v", got, want)
+	}
+}
+
+func ids(races []*racing.Race) []int64 {
+	ids := make([]int64, 0, len(races))
+	for _, race := range races {
+		ids = append(ids, race.Id)
+	}
+
+	return ids
+}
+
+func roundTrip(t *testing.T, cursor *db.Cursor) *db.Cursor {
+	t.Helper()
+
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded db.Cursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	return &decoded
+}
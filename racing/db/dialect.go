@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Dialect describes how the SQL understood by a database driver differs from
+// the SQLite flavoured SQL our queries are written in.
+type Dialect struct {
+	// Driver is the database/sql driver name.
+	Driver string
+
+	// system identifies the database in traces, as an OpenTelemetry
+	// db.system value.
+	system string
+
+	// migrations is the directory, under migrations/, holding the dialect's
+	// schema migrations.
+	migrations string
+
+	// numberedParams is set when placeholders are numbered, i.e. $1, $2...
+	// rather than ?.
+	numberedParams bool
+
+	// utcTime is a format wrapping a time column or parameter so that it
+	// compares as a UTC timestamp, whatever the offset it carries and the
+	// session's time zone.
+	utcTime string
+
+	// returningID is set when inserts report the ID they assigned with a
+	// RETURNING clause, rather than through LastInsertId.
+	returningID bool
+
+	// migrationsTable creates the schema_migrations table.
+	migrationsTable string
+
+	// dsnParams are appended to every DSN as query parameters, to configure
+	// each connection the driver opens, e.g. as SQLite only enforces foreign
+	// keys on connections which ask it to.
+	dsnParams string
+
+	// lockRows, appended to a SELECT within a transaction, locks the rows
+	// read against other writers until the transaction ends. SQLite has no
+	// such clause, so begins every transaction by taking its write lock.
+	lockRows string
+
+	// syncSequences, if set, moves the races ID sequence past rows inserted
+	// with explicit IDs. Races are the only rows we assign IDs to, so the
+	// only ones with a sequence; meeting and runner IDs always come from
+	// fixtures.
+	syncSequences string
+}
+
+var (
+	// SQLite is the dialect of github.com/mattn/go-sqlite3.
+	SQLite = Dialect{
+		Driver:          "sqlite3",
+		system:          "sqlite",
+		migrations:      "sqlite",
+		utcTime:         "datetime(%s)",
+		dsnParams:       "_foreign_keys=on&_txlock=immediate",
+		migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at DATETIME NOT NULL)`,
+	}
+
+	// Postgres is the dialect of github.com/lib/pq.
+	Postgres = Dialect{
+		Driver:          "postgres",
+		system:          "postgresql",
+		migrations:      "postgres",
+		numberedParams:  true,
+		utcTime:         "(CAST(%s AS TIMESTAMPTZ) AT TIME ZONE 'UTC')",
+		returningID:     true,
+		lockRows:        " FOR UPDATE",
+		migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT PRIMARY KEY, name TEXT NOT NULL, checksum TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL)`,
+		syncSequences:   `SELECT setval(pg_get_serial_sequence('races', 'id'), GREATEST((SELECT MAX(id) FROM races), 1))`,
+	}
+)
+
+// DialectFor returns the dialect of the named driver.
+func DialectFor(driver string) (Dialect, error) {
+	switch driver {
+	case SQLite.Driver:
+		return SQLite, nil
+	case Postgres.Driver:
+		return Postgres, nil
+	}
+
+	return Dialect{}, fmt.Errorf("unsupported database driver %q, expected %s or %s", driver, SQLite.Driver, Postgres.Driver)
+}
+
+// rebind rewrites the ? placeholders in query into the dialect's own.
+func (d Dialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var (
+		b      strings.Builder
+		n      int
+		quoted bool
+	)
+
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// time wraps a time column or parameter so that it compares as a UTC
+// timestamp, regardless of the offset it was stored with.
+func (d Dialect) time(expr string) string {
+	return fmt.Sprintf(d.utcTime, expr)
+}
+
+// DB is a database handle which adapts our queries to its dialect. Queries
+// are written with ? placeholders, whatever the driver.
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Open opens a database using the named driver.
+func Open(driver, dsn string) (*DB, error) {
+	dialect, err := DialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	if dialect.dsnParams != "" {
+		if strings.Contains(dsn, "?") {
+			dsn += "&" + dialect.dsnParams
+		} else {
+			dsn += "?" + dialect.dsnParams
+		}
+	}
+
+	db, err := sql.Open(dialect.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{DB: db, Dialect: dialect}, nil
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.Dialect.rebind(query), args...)
+}
+
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.Dialect.rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.Dialect.rebind(query), args...)
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.Dialect.rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{Tx: tx, dialect: db.Dialect}, nil
+}
+
+// Tx is a transaction which adapts our queries to its dialect.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.rebind(query))
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// meetingDateLayout is the layout meeting dates are stored and returned in.
+const meetingDateLayout = "2006-01-02"
+
+// MeetingsRepo provides repository access to meetings.
+type MeetingsRepo interface {
+	// List will return a list of meetings, ordered by date then ID.
+	List(filter *racing.ListMeetingsRequestFilter) ([]*racing.Meeting, error)
+
+	// Get will return a single meeting by its ID, or ErrNotFound if no such meeting exists.
+	Get(id int64) (*racing.Meeting, error)
+}
+
+type meetingsRepo struct {
+	db *DB
+}
+
+// NewMeetingsRepo creates a new meetings repository.
+func NewMeetingsRepo(db *DB) MeetingsRepo {
+	return &meetingsRepo{db: db}
+}
+
+func (r *meetingsRepo) List(filter *racing.ListMeetingsRequestFilter) ([]*racing.Meeting, error) {
+	var (
+		err   error
+		query string
+		args  []interface{}
+	)
+
+	query = getMeetingQueries()[meetingsList]
+
+	query, args = r.applyFilter(query, filter)
+
+	query += " ORDER BY date, id"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.scanMeetings(rows)
+}
+
+func (r *meetingsRepo) Get(id int64) (*racing.Meeting, error) {
+	rows, err := r.db.Query(getMeetingQueries()[meetingsGet], id)
+	if err != nil {
+		return nil, err
+	}
+
+	meetings, err := r.scanMeetings(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(meetings) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return meetings[0], nil
+}
+
+func (r *meetingsRepo) applyFilter(query string, filter *racing.ListMeetingsRequestFilter) (string, []interface{}) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	if filter == nil {
+		return query, args
+	}
+
+	if len(filter.Ids) > 0 {
+		clauses = append(clauses, "id IN ("+strings.Repeat("?,", len(filter.Ids)-1)+"?)")
+
+		for _, id := range filter.Ids {
+			args = append(args, id)
+		}
+	}
+
+	if len(filter.RaceTypes) > 0 {
+		clauses = append(clauses, "race_type IN ("+strings.Repeat("?,", len(filter.RaceTypes)-1)+"?)")
+
+		for _, raceType := range filter.RaceTypes {
+			args = append(args, int32(raceType))
+		}
+	}
+
+	if len(clauses) != 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	return query, args
+}
+
+func (m *meetingsRepo) scanMeetings(
+	rows *sql.Rows,
+) ([]*racing.Meeting, error) {
+	var meetings []*racing.Meeting
+
+	for rows.Next() {
+		var meeting racing.Meeting
+
+		if err := rows.Scan(&meeting.Id, &meeting.Venue, &meeting.Country, &meeting.RaceType, &meeting.Date); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		meetings = append(meetings, &meeting)
+	}
+
+	return meetings, nil
+}
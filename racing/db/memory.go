@@ -0,0 +1,530 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MemoryDriver selects the in-memory store rather than a SQL database.
+const MemoryDriver = "memory"
+
+// MemoryDB holds meetings, races and runners in memory, for tests and demos
+// which shouldn't need a database. It is safe for concurrent use, and
+// nothing survives the process exiting.
+type MemoryDB struct {
+	mu       sync.RWMutex
+	meetings map[int64]*racing.Meeting
+	races    map[int64]*memoryRace
+	runners  map[int64]*racing.Runner
+}
+
+// memoryRace is a stored race along with the version its etag is taken from.
+type memoryRace struct {
+	race    *racing.Race
+	version int64
+}
+
+// NewMemoryDB creates an empty in-memory store.
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		meetings: make(map[int64]*racing.Meeting),
+		races:    make(map[int64]*memoryRace),
+		runners:  make(map[int64]*racing.Runner),
+	}
+}
+
+// Seed adds fixtures to the store. As with Seed, records which already exist
+// are left untouched, and nothing is added if any fixture is invalid.
+func (m *MemoryDB) Seed(fixtures *Fixtures) error {
+	meetings := make([]*racing.Meeting, 0, len(fixtures.Meetings))
+	for _, fixture := range fixtures.Meetings {
+		meeting, err := fixture.meeting()
+		if err != nil {
+			return err
+		}
+
+		meetings = append(meetings, meeting)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, meeting := range meetings {
+		if _, ok := m.meetings[meeting.Id]; !ok {
+			m.meetings[meeting.Id] = meeting
+		}
+	}
+
+	for _, fixture := range fixtures.Races {
+		if _, ok := m.races[fixture.ID]; ok {
+			continue
+		}
+
+		m.races[fixture.ID] = &memoryRace{
+			race: &racing.Race{
+				Id:                  fixture.ID,
+				MeetingId:           fixture.MeetingID,
+				Name:                fixture.Name,
+				Number:              fixture.Number,
+				Visible:             fixture.Visible,
+				AdvertisedStartTime: storedTime(timestamppb.New(fixture.AdvertisedStartTime)),
+			},
+			version: 1,
+		}
+	}
+
+	for _, fixture := range fixtures.Runners {
+		if _, ok := m.runners[fixture.ID]; ok {
+			continue
+		}
+
+		m.runners[fixture.ID] = &racing.Runner{
+			Id:                fixture.ID,
+			RaceId:            fixture.RaceID,
+			Barrier:           fixture.Barrier,
+			SaddleClothNumber: fixture.SaddleClothNumber,
+			Name:              fixture.Name,
+			Jockey:            fixture.Jockey,
+			Trainer:           fixture.Trainer,
+			Weight:            fixture.Weight,
+			Scratched:         fixture.Scratched,
+		}
+	}
+
+	return nil
+}
+
+// storedTime truncates a time to whole seconds in UTC, as the SQL stores
+// hold them.
+func storedTime(ts *timestamppb.Timestamp) *timestamppb.Timestamp {
+	return timestamppb.New(ts.AsTime().UTC().Truncate(time.Second))
+}
+
+type memoryRacesRepo struct {
+	mem  *MemoryDB
+	now  func() time.Time
+	feed *changeFeed
+}
+
+// NewMemoryRacesRepo creates a races repository backed by mem. It behaves
+// the same as NewRacesRepo, including its filtering, ordering, paging and
+// etags.
+func NewMemoryRacesRepo(mem *MemoryDB, now func() time.Time) RacesRepo {
+	return &memoryRacesRepo{mem: mem, now: now, feed: newChangeFeed(now())}
+}
+
+func (r *memoryRacesRepo) List(_ context.Context, filter *racing.ListRacesRequestFilter, opts ListOptions) ([]*racing.Race, *Cursor, error) {
+	terms, err := orderTerms(opts.OrderBy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := r.now()
+
+	r.mem.mu.RLock()
+	var races []*racing.Race
+	for _, stored := range r.mem.races {
+		race := stored.snapshot(now)
+		if !MatchesFilter(race, filter) {
+			continue
+		}
+
+		if opts.After != nil {
+			after, err := sortsAfter(race, terms, opts.After)
+			if err != nil {
+				r.mem.mu.RUnlock()
+				return nil, nil, err
+			}
+
+			if !after {
+				continue
+			}
+		}
+
+		races = append(races, race)
+	}
+	r.mem.mu.RUnlock()
+
+	sort.Slice(races, func(i, j int) bool {
+		for _, term := range terms {
+			c, _ := compareSortKeys(sortKey(races[i], term.field), sortKey(races[j], term.field))
+			if term.desc {
+				c = -c
+			}
+
+			if c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+
+	return paginate(races, terms, opts.PageSize)
+}
+
+func (r *memoryRacesRepo) Get(id int64) (*racing.Race, error) {
+	r.mem.mu.RLock()
+	defer r.mem.mu.RUnlock()
+
+	stored, ok := r.mem.races[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return stored.snapshot(r.now()), nil
+}
+
+func (r *memoryRacesRepo) Create(race *racing.Race) (*racing.Race, error) {
+	r.mem.mu.Lock()
+
+	// IDs follow on from the highest in use, as SQLite assigns them.
+	var id int64
+	for existing := range r.mem.races {
+		if existing > id {
+			id = existing
+		}
+	}
+	id++
+
+	stored := &memoryRace{
+		race: &racing.Race{
+			Id:                  id,
+			MeetingId:           race.MeetingId,
+			Name:                race.Name,
+			Number:              race.Number,
+			Visible:             race.Visible,
+			AdvertisedStartTime: storedTime(race.AdvertisedStartTime),
+		},
+		version: 1,
+	}
+	r.mem.races[id] = stored
+
+	created := stored.snapshot(r.now())
+
+	// Changes are published under the lock, so the feed holds them in the
+	// order they were made.
+	r.feed.publish(ChangeCreated, nil, created)
+	r.mem.mu.Unlock()
+
+	return created, nil
+}
+
+func (r *memoryRacesRepo) Update(race *racing.Race, fields []string) (*racing.Race, error) {
+	for _, field := range fields {
+		if _, ok := raceUpdateColumns[field]; !ok {
+			return nil, fmt.Errorf("%w: cannot update field %q", ErrInvalidArgument, field)
+		}
+	}
+
+	r.mem.mu.Lock()
+
+	stored, err := r.mem.current(race.Id, race.Etag)
+	if err != nil {
+		r.mem.mu.Unlock()
+		return nil, err
+	}
+
+	// With nothing to write, the etag still had to match.
+	if len(fields) == 0 {
+		current := stored.snapshot(r.now())
+		r.mem.mu.Unlock()
+
+		return current, nil
+	}
+
+	// Stored races are shared with earlier snapshots, so are replaced rather
+	// than modified.
+	next := proto.Clone(stored.race).(*racing.Race)
+	for _, field := range fields {
+		switch field {
+		case "meeting_id":
+			next.MeetingId = race.MeetingId
+		case "name":
+			next.Name = race.Name
+		case "number":
+			next.Number = race.Number
+		case "visible":
+			next.Visible = race.Visible
+		case "advertised_start_time":
+			next.AdvertisedStartTime = storedTime(race.AdvertisedStartTime)
+		}
+	}
+
+	previous := stored.snapshot(r.now())
+
+	stored = &memoryRace{race: next, version: stored.version + 1}
+	r.mem.races[race.Id] = stored
+
+	updated := stored.snapshot(r.now())
+
+	r.feed.publish(ChangeUpdated, previous, updated)
+	r.mem.mu.Unlock()
+
+	return updated, nil
+}
+
+func (r *memoryRacesRepo) Delete(id int64, etag string) error {
+	r.mem.mu.Lock()
+
+	stored, err := r.mem.current(id, etag)
+	if err != nil {
+		r.mem.mu.Unlock()
+		return err
+	}
+
+	delete(r.mem.races, id)
+	for runnerID, runner := range r.mem.runners {
+		if runner.RaceId == id {
+			delete(r.mem.runners, runnerID)
+		}
+	}
+
+	race := stored.snapshot(r.now())
+
+	r.feed.publish(ChangeDeleted, nil, race)
+	r.mem.mu.Unlock()
+
+	return nil
+}
+
+func (r *memoryRacesRepo) Subscribe(after uint64) *Subscription {
+	return r.feed.subscribe(after)
+}
+
+func (r *memoryRacesRepo) WatchClosures(ctx context.Context, interval time.Duration) {
+	watchClosures(ctx, interval, r.now, r.feed, r.startedBetween)
+}
+
+// startedBetween returns the races advertised to start after since, up to
+// and including until, compared to the second as the SQL stores do.
+func (r *memoryRacesRepo) startedBetween(since, until time.Time) ([]*racing.Race, error) {
+	since, until = since.Truncate(time.Second), until.Truncate(time.Second)
+	now := r.now()
+
+	r.mem.mu.RLock()
+	defer r.mem.mu.RUnlock()
+
+	var races []*racing.Race
+	for _, stored := range r.mem.races {
+		start := stored.race.AdvertisedStartTime.AsTime()
+		if start.After(since) && !start.After(until) {
+			races = append(races, stored.snapshot(now))
+		}
+	}
+
+	sort.Slice(races, func(i, j int) bool {
+		return races[i].Id < races[j].Id
+	})
+
+	return races, nil
+}
+
+// current returns the stored race with the given id, provided etag is empty
+// or matches its version. The caller must hold the lock.
+func (m *MemoryDB) current(id int64, etag string) (*memoryRace, error) {
+	stored, ok := m.races[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	if etag != "" && etag != strconv.FormatInt(stored.version, 10) {
+		return nil, ErrEtagMismatch
+	}
+
+	return stored, nil
+}
+
+// snapshot returns a copy of the race for handing to callers, with its
+// status as of now and its etag.
+func (s *memoryRace) snapshot(now time.Time) *racing.Race {
+	race := proto.Clone(s.race).(*racing.Race)
+	race.Status = raceStatus(race.AdvertisedStartTime.AsTime(), now)
+	race.Etag = strconv.FormatInt(s.version, 10)
+
+	return race
+}
+
+// sortsAfter reports whether race sorts after the cursor, the in-memory
+// equivalent of keysetClause.
+func sortsAfter(race *racing.Race, terms []orderTerm, after *Cursor) (bool, error) {
+	for _, term := range terms {
+		v, err := after.value(term.field)
+		if err != nil {
+			return false, err
+		}
+
+		c, err := compareSortKeys(sortKey(race, term.field), v)
+		if err != nil {
+			return false, err
+		}
+
+		if term.desc {
+			c = -c
+		}
+
+		if c != 0 {
+			return c > 0, nil
+		}
+	}
+
+	return false, nil
+}
+
+// compareSortKeys compares two values returned by sortKey, or taken from a
+// Cursor, returning -1, 0 or 1 as a sorts before, with or after b. False
+// sorts before true, as it does in SQL.
+func compareSortKeys(a, b interface{}) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		if b, ok := b.(int64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+
+			return 0, nil
+		}
+	case string:
+		// Times are formatted with sortKeyTimeLayout, so sort as strings.
+		if b, ok := b.(string); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+
+			return 0, nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0, nil
+			case b:
+				return -1, nil
+			}
+
+			return 1, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: page token does not match order_by", ErrInvalidArgument)
+}
+
+type memoryMeetingsRepo struct {
+	mem *MemoryDB
+}
+
+// NewMemoryMeetingsRepo creates a meetings repository backed by mem.
+func NewMemoryMeetingsRepo(mem *MemoryDB) MeetingsRepo {
+	return &memoryMeetingsRepo{mem: mem}
+}
+
+func (r *memoryMeetingsRepo) List(filter *racing.ListMeetingsRequestFilter) ([]*racing.Meeting, error) {
+	if filter == nil {
+		filter = &racing.ListMeetingsRequestFilter{}
+	}
+
+	r.mem.mu.RLock()
+	var meetings []*racing.Meeting
+	for _, meeting := range r.mem.meetings {
+		if len(filter.Ids) > 0 && !containsID(filter.Ids, meeting.Id) {
+			continue
+		}
+
+		if len(filter.RaceTypes) > 0 && !containsRaceType(filter.RaceTypes, meeting.RaceType) {
+			continue
+		}
+
+		meetings = append(meetings, proto.Clone(meeting).(*racing.Meeting))
+	}
+	r.mem.mu.RUnlock()
+
+	sort.Slice(meetings, func(i, j int) bool {
+		if meetings[i].Date != meetings[j].Date {
+			return meetings[i].Date < meetings[j].Date
+		}
+
+		return meetings[i].Id < meetings[j].Id
+	})
+
+	return meetings, nil
+}
+
+func (r *memoryMeetingsRepo) Get(id int64) (*racing.Meeting, error) {
+	r.mem.mu.RLock()
+	defer r.mem.mu.RUnlock()
+
+	meeting, ok := r.mem.meetings[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return proto.Clone(meeting).(*racing.Meeting), nil
+}
+
+type memoryRunnersRepo struct {
+	mem *MemoryDB
+}
+
+// NewMemoryRunnersRepo creates a runners repository backed by mem.
+func NewMemoryRunnersRepo(mem *MemoryDB) RunnersRepo {
+	return &memoryRunnersRepo{mem: mem}
+}
+
+func (r *memoryRunnersRepo) List(raceIDs []int64) ([]*racing.Runner, error) {
+	if len(raceIDs) == 0 {
+		return nil, nil
+	}
+
+	r.mem.mu.RLock()
+	var runners []*racing.Runner
+	for _, runner := range r.mem.runners {
+		if containsID(raceIDs, runner.RaceId) {
+			runners = append(runners, proto.Clone(runner).(*racing.Runner))
+		}
+	}
+	r.mem.mu.RUnlock()
+
+	sort.Slice(runners, func(i, j int) bool {
+		if runners[i].RaceId != runners[j].RaceId {
+			return runners[i].RaceId < runners[j].RaceId
+		}
+
+		return runners[i].SaddleClothNumber < runners[j].SaddleClothNumber
+	})
+
+	return runners, nil
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsRaceType(raceTypes []racing.Meeting_RaceType, raceType racing.Meeting_RaceType) bool {
+	for _, candidate := range raceTypes {
+		if candidate == raceType {
+			return true
+		}
+	}
+
+	return false
+}
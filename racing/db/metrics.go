@@ -0,0 +1,37 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// queryDuration times the queries made by racesRepo, by the repository
+	// operation they serve.
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "racing_db_query_duration_seconds",
+		Help:    "Time taken by races database queries, by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+
+	// cacheRequests counts reads of the races cache. A shared result is a
+	// miss which was collapsed into an identical one already in flight.
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "racing_races_cache_requests_total",
+		Help: "Reads of the races cache, by method and result (hit, miss or shared).",
+	}, []string{"method", "result"})
+)
+
+// timeQuery starts timing a query for operation, returning a func which
+// records its duration when called, e.g.
+//
+//	defer timeQuery("list")()
+func timeQuery(operation string) func() {
+	start := time.Now()
+
+	return func() {
+		queryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+var (
+	// ErrSchemaAhead is returned when the database has migrations applied
+	// which this binary doesn't know about, i.e. it was migrated by a newer
+	// release.
+	ErrSchemaAhead = errors.New("database schema is ahead of this binary")
+
+	// ErrChecksumMismatch is returned when a migration applied to the
+	// database differs from the one embedded in this binary.
+	ErrChecksumMismatch = errors.New("migration checksum mismatch")
+)
+
+// Migration is a single, versioned change to the database schema. Each
+// migration lives in its dialect's directory under migrations/, as a pair of
+// NNNN_name.up.sql and NNNN_name.down.sql scripts. Every dialect has the same
+// migrations, so versions mean the same thing whichever database is used.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationState describes whether a migration has been applied.
+type MigrationState string
+
+const (
+	// MigrationPending migrations are yet to be applied.
+	MigrationPending MigrationState = "pending"
+
+	// MigrationApplied migrations have been applied, and match this binary.
+	MigrationApplied MigrationState = "applied"
+
+	// MigrationModified migrations were applied, but have since changed.
+	MigrationModified MigrationState = "modified"
+
+	// MigrationUnknown migrations were applied by a newer binary.
+	MigrationUnknown MigrationState = "unknown"
+)
+
+// MigrationStatus reports the state of a single migration.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	State     MigrationState
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts schema migrations, recording those applied
+// in the schema_migrations table.
+type Migrator interface {
+	// Up will apply every pending migration, in order.
+	Up() error
+
+	// Down will revert the most recently applied migration.
+	Down() error
+
+	// Status will report the state of every known or applied migration,
+	// ordered by version.
+	Status() ([]MigrationStatus, error)
+
+	// Check will return ErrSchemaAhead or ErrChecksumMismatch if the
+	// database can't safely be used by this binary.
+	Check() error
+}
+
+type migrator struct {
+	db *DB
+}
+
+// NewMigrator creates a new migrator for the given database.
+func NewMigrator(db *DB) Migrator {
+	return &migrator{db: db}
+}
+
+// appliedMigration is a row of the schema_migrations table.
+type appliedMigration struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+func (m *migrator) Up() error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations(m.db.Dialect)
+	if err != nil {
+		return err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := m.apply(migration); err != nil {
+			return fmt.Errorf("failed applying migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *migrator) Down() error {
+	if err := m.Check(); err != nil {
+		return err
+	}
+
+	migrations, err := loadMigrations(m.db.Dialect)
+	if err != nil {
+		return err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		if err := m.revert(migration); err != nil {
+			return fmt.Errorf("failed reverting migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+func (m *migrator) Status() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(m.db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name, State: MigrationPending}
+
+		if row, ok := applied[migration.Version]; ok {
+			status.State = MigrationApplied
+			status.AppliedAt = row.appliedAt
+
+			if row.checksum != migration.Checksum {
+				status.State = MigrationModified
+			}
+
+			delete(applied, migration.Version)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	// Anything left was applied by a newer binary.
+	for _, row := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Version:   row.version,
+			Name:      row.name,
+			State:     MigrationUnknown,
+			AppliedAt: row.appliedAt,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+
+	return statuses, nil
+}
+
+func (m *migrator) Check() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+
+	for _, status := range statuses {
+		switch status.State {
+		case MigrationUnknown:
+			return fmt.Errorf("%w: migration %d_%s is not known", ErrSchemaAhead, status.Version, status.Name)
+		case MigrationModified:
+			return fmt.Errorf("%w: migration %d_%s has changed since it was applied", ErrChecksumMismatch, status.Version, status.Name)
+		}
+	}
+
+	return nil
+}
+
+// applied returns the migrations recorded in schema_migrations, keyed by
+// version, creating the table if need be.
+func (m *migrator) applied() (map[int64]appliedMigration, error) {
+	if _, err := m.db.Exec(m.db.Dialect.migrationsTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.db.Query(`SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]appliedMigration)
+	for rows.Next() {
+		var row appliedMigration
+
+		if err := rows.Scan(&row.version, &row.name, &row.checksum, &row.appliedAt); err != nil {
+			return nil, err
+		}
+
+		applied[row.version] = row
+	}
+
+	return applied, rows.Err()
+}
+
+// apply runs a migration's up script and records it, in one transaction.
+func (m *migrator) apply(migration Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Scripts take no parameters, so are run as they are.
+	if _, err := tx.Tx.Exec(migration.Up); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO schema_migrations(version, name, checksum, applied_at) VALUES (?,?,?,?)`,
+		migration.Version,
+		migration.Name,
+		migration.Checksum,
+		time.Now().UTC().Format(time.RFC3339),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revert runs a migration's down script and forgets it, in one transaction.
+func (m *migrator) revert(migration Migration) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Tx.Exec(migration.Down); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, migration.Version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// loadMigrations reads the dialect's embedded migrations, ordered by version.
+func loadMigrations(dialect Dialect) ([]Migration, error) {
+	dir := path.Join("migrations", dialect.migrations)
+
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %q", name)
+		}
+
+		parts := strings.SplitN(strings.TrimSuffix(name, "."+direction+".sql"), "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration file %q is not named NNNN_name.%s.sql", name, direction)
+		}
+
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %q has an invalid version: %w", name, err)
+		}
+
+		script, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+
+		if direction == "up" {
+			sum := sha256.Sum256(script)
+			migration.Up = string(script)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both up and down scripts", migration.Version, migration.Name)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
@@ -0,0 +1,114 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+)
+
+func TestSQLiteMigrations(t *testing.T) {
+	testMigrations(t, dbtest.SQLite(t))
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	testMigrations(t, dbtest.Postgres(t))
+}
+
+// testMigrations checks every migration reverts and reapplies over seeded
+// data, and that the schema enforces its foreign keys.
+func testMigrations(t *testing.T, database *db.DB) {
+	for _, table := range []string{"runners", "races", "meetings", "schema_migrations"} {
+		if _, err := database.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			t.Fatalf("failed dropping %s: %s", table, err)
+		}
+	}
+
+	migrator := db.NewMigrator(database)
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+
+	start := time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC)
+	err := db.Seed(database, &db.Fixtures{
+		Meetings: []db.MeetingFixture{
+			{ID: 1, Venue: "Flemington", Country: "AU", RaceType: "THOROUGHBRED", Date: "2030-01-01"},
+			{ID: 2, Venue: "Menangle", Country: "AU", RaceType: "HARNESS", Date: "2030-01-01"},
+		},
+		Races: []db.RaceFixture{
+			{ID: 1, MeetingID: 1, Name: "Alpha", Number: 1, Visible: true, AdvertisedStartTime: start},
+			{ID: 2, MeetingID: 1, Name: "Bravo", Number: 2, Visible: true, AdvertisedStartTime: start},
+		},
+		Runners: []db.RunnerFixture{
+			{ID: 1, RaceID: 1, Barrier: 1, SaddleClothNumber: 1, Name: "Gold Trip"},
+			{ID: 2, RaceID: 2, Barrier: 1, SaddleClothNumber: 1, Name: "Verry Elleegant"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Seed: %s", err)
+	}
+
+	// Revert everything but the tables the fixtures live in, then reapply.
+	for i := 0; i < 2; i++ {
+		if err := migrator.Down(); err != nil {
+			t.Fatalf("Down: %s", err)
+		}
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Up after Down: %s", err)
+	}
+
+	for table, want := range map[string]int{"meetings": 2, "races": 2, "runners": 2} {
+		var got int
+		if err := database.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%d %s after migrating down and up, want %d", got, table, want)
+		}
+	}
+
+	if _, err := database.Exec(`INSERT INTO races(id, meeting_id, name, number) VALUES (3, 99, 'Charlie', 3)`); err == nil {
+		t.Error("inserted a race of a missing meeting, want a foreign key violation")
+	}
+	if _, err := database.Exec(`INSERT INTO runners(id, race_id, name) VALUES (3, 99, 'Winx')`); err == nil {
+		t.Error("inserted a runner of a missing race, want a foreign key violation")
+	}
+	if _, err := database.Exec(`DELETE FROM meetings WHERE id = 1`); err == nil {
+		t.Error("deleted a meeting with races, want a foreign key violation")
+	}
+
+	// Runners go with their race.
+	if _, err := database.Exec(`DELETE FROM races WHERE id = 1`); err != nil {
+		t.Fatalf("deleting a race with runners: %s", err)
+	}
+
+	var runners int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM runners WHERE race_id = 1`).Scan(&runners); err != nil {
+		t.Fatal(err)
+	}
+	if runners != 0 {
+		t.Errorf("%d runners left after deleting their race, want 0", runners)
+	}
+
+	// A meeting without races can be deleted.
+	if _, err := database.Exec(`DELETE FROM meetings WHERE id = 2`); err != nil {
+		t.Errorf("deleting a meeting without races: %s", err)
+	}
+
+	// Reverting all the way leaves nothing behind.
+	for {
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statuses[0].State == db.MigrationPending {
+			break
+		}
+
+		if err := migrator.Down(); err != nil {
+			t.Fatalf("Down: %s", err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+-- Dates are kept as YYYY-MM-DD text, as they are in SQLite.
+CREATE TABLE IF NOT EXISTS meetings (
+    id BIGINT PRIMARY KEY,
+    venue TEXT,
+    country TEXT,
+    race_type INTEGER,
+    date TEXT
+);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS runners (
+    id BIGINT PRIMARY KEY,
+    race_id BIGINT REFERENCES races(id),
+    barrier BIGINT,
+    saddle_cloth_number BIGINT,
+    name TEXT,
+    jockey TEXT,
+    trainer TEXT,
+    weight DOUBLE PRECISION,
+    scratched BOOLEAN
+);
@@ -0,0 +1 @@
+ALTER TABLE races ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
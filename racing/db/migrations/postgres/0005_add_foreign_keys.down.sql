@@ -0,0 +1,5 @@
+ALTER TABLE races DROP CONSTRAINT races_meeting_id_fkey;
+
+ALTER TABLE runners
+    DROP CONSTRAINT runners_race_id_fkey,
+    ADD CONSTRAINT runners_race_id_fkey FOREIGN KEY (race_id) REFERENCES races(id);
@@ -0,0 +1,8 @@
+-- Meetings outlive their races, and can't be deleted while they have any.
+ALTER TABLE races
+    ADD CONSTRAINT races_meeting_id_fkey FOREIGN KEY (meeting_id) REFERENCES meetings(id) ON DELETE RESTRICT;
+
+-- Runners go with their race.
+ALTER TABLE runners
+    DROP CONSTRAINT runners_race_id_fkey,
+    ADD CONSTRAINT runners_race_id_fkey FOREIGN KEY (race_id) REFERENCES races(id) ON DELETE CASCADE;
@@ -0,0 +1,10 @@
+-- Databases created before migrations were introduced already have this
+-- table, so it is adopted rather than recreated.
+CREATE TABLE IF NOT EXISTS races (
+    id INTEGER PRIMARY KEY,
+    meeting_id INTEGER,
+    name TEXT,
+    number INTEGER,
+    visible INTEGER,
+    advertised_start_time DATETIME
+);
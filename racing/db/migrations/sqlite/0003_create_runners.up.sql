@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS runners (
+    id INTEGER PRIMARY KEY,
+    race_id INTEGER REFERENCES races(id),
+    barrier INTEGER,
+    saddle_cloth_number INTEGER,
+    name TEXT,
+    jockey TEXT,
+    trainer TEXT,
+    weight REAL,
+    scratched INTEGER
+);
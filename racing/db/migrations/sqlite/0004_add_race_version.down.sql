@@ -0,0 +1,35 @@
+-- SQLite can't drop columns, so the table is rebuilt without it. Runners are
+-- rebuilt along with it, so that they reference the new table and dropping
+-- the old one doesn't trip their foreign key.
+ALTER TABLE runners RENAME TO runners_old;
+ALTER TABLE races RENAME TO races_old;
+
+CREATE TABLE races (
+    id INTEGER PRIMARY KEY,
+    meeting_id INTEGER,
+    name TEXT,
+    number INTEGER,
+    visible INTEGER,
+    advertised_start_time DATETIME
+);
+
+CREATE TABLE runners (
+    id INTEGER PRIMARY KEY,
+    race_id INTEGER REFERENCES races(id),
+    barrier INTEGER,
+    saddle_cloth_number INTEGER,
+    name TEXT,
+    jockey TEXT,
+    trainer TEXT,
+    weight REAL,
+    scratched INTEGER
+);
+
+INSERT INTO races (id, meeting_id, name, number, visible, advertised_start_time)
+SELECT id, meeting_id, name, number, visible, advertised_start_time FROM races_old;
+
+INSERT INTO runners (id, race_id, barrier, saddle_cloth_number, name, jockey, trainer, weight, scratched)
+SELECT id, race_id, barrier, saddle_cloth_number, name, jockey, trainer, weight, scratched FROM runners_old;
+
+DROP TABLE runners_old;
+DROP TABLE races_old;
@@ -0,0 +1 @@
+ALTER TABLE races ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,38 @@
+-- SQLite can't add constraints to existing tables, so races and runners are
+-- rebuilt with them. Renaming the old tables first repoints runners at the
+-- old races, so neither drop touches the new tables.
+ALTER TABLE runners RENAME TO runners_old;
+ALTER TABLE races RENAME TO races_old;
+
+-- Meetings outlive their races, and can't be deleted while they have any.
+CREATE TABLE races (
+    id INTEGER PRIMARY KEY,
+    meeting_id INTEGER REFERENCES meetings(id) ON DELETE RESTRICT,
+    name TEXT,
+    number INTEGER,
+    visible INTEGER,
+    advertised_start_time DATETIME,
+    version INTEGER NOT NULL DEFAULT 1
+);
+
+-- Runners go with their race.
+CREATE TABLE runners (
+    id INTEGER PRIMARY KEY,
+    race_id INTEGER REFERENCES races(id) ON DELETE CASCADE,
+    barrier INTEGER,
+    saddle_cloth_number INTEGER,
+    name TEXT,
+    jockey TEXT,
+    trainer TEXT,
+    weight REAL,
+    scratched INTEGER
+);
+
+INSERT INTO races (id, meeting_id, name, number, visible, advertised_start_time, version)
+SELECT id, meeting_id, name, number, visible, advertised_start_time, version FROM races_old;
+
+INSERT INTO runners (id, race_id, barrier, saddle_cloth_number, name, jockey, trainer, weight, scratched)
+SELECT id, race_id, barrier, saddle_cloth_number, name, jockey, trainer, weight, scratched FROM runners_old;
+
+DROP TABLE runners_old;
+DROP TABLE races_old;
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultRaceOrderBy is used when the caller does not specify an ordering.
+const defaultRaceOrderBy = "advertised_start_time"
+
+// raceOrderColumns maps the Race fields which may appear in an order_by onto
+// their SQL columns. Only fields listed here are accepted, which keeps caller
+// input out of the generated SQL.
+var raceOrderColumns = map[string]string{
+	"id":                    "id",
+	"meeting_id":            "meeting_id",
+	"name":                  "name",
+	"number":                "number",
+	"visible":               "visible",
+	"advertised_start_time": "advertised_start_time",
+}
+
+// raceTimeFields are the order_by fields holding times.
+var raceTimeFields = map[string]bool{
+	"advertised_start_time": true,
+}
+
+// orderTerm is a single parsed field of an order_by clause.
+type orderTerm struct {
+	field string
+	desc  bool
+}
+
+// parseOrderBy parses an AIP-132 order_by string such as
+// "advertised_start_time desc, number" into its terms. Fields must be listed
+// in columns, otherwise an error wrapping ErrInvalidArgument is returned.
+func parseOrderBy(orderBy string, columns map[string]string) ([]orderTerm, error) {
+	var terms []orderTerm
+
+	for _, part := range strings.Split(orderBy, ",") {
+		words := strings.Fields(part)
+
+		var term orderTerm
+		switch {
+		case len(words) == 1:
+		case len(words) == 2 && strings.EqualFold(words[1], "desc"):
+			term.desc = true
+		case len(words) == 2 && strings.EqualFold(words[1], "asc"):
+		default:
+			return nil, fmt.Errorf("%w: malformed order_by %q", ErrInvalidArgument, orderBy)
+		}
+
+		term.field = words[0]
+		if _, ok := columns[term.field]; !ok {
+			return nil, fmt.Errorf("%w: cannot order by unknown field %q", ErrInvalidArgument, term.field)
+		}
+
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// orderTerms parses orderBy, falling back to the default ordering when it is
+// empty. The terms always end with id so that rows sharing a sort key are
+// still returned in a stable order.
+func orderTerms(orderBy string) ([]orderTerm, error) {
+	if strings.TrimSpace(orderBy) == "" {
+		orderBy = defaultRaceOrderBy
+	}
+
+	terms, err := parseOrderBy(orderBy, raceOrderColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, term := range terms {
+		if term.field == "id" {
+			return terms, nil
+		}
+	}
+
+	return append(terms, orderTerm{field: "id"}), nil
+}
+
+// orderExpr returns the SQL expression a race field is sorted by. Times are
+// normalised to UTC so they compare correctly regardless of the offset they
+// were stored with.
+func (r *racesRepo) orderExpr(field string) string {
+	if raceTimeFields[field] {
+		return r.db.Dialect.time(raceOrderColumns[field])
+	}
+
+	return raceOrderColumns[field]
+}
+
+// orderParam returns the placeholder a cursor's key for a race field is
+// compared through, normalised to UTC as orderExpr is.
+func (r *racesRepo) orderParam(field string) string {
+	if raceTimeFields[field] {
+		return r.db.Dialect.time("?")
+	}
+
+	return "?"
+}
+
+func (r *racesRepo) applyOrder(query string, terms []orderTerm) string {
+	clauses := make([]string, 0, len(terms))
+	for _, term := range terms {
+		clause := r.orderExpr(term.field)
+		if term.desc {
+			clause += " DESC"
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	return query + " ORDER BY " + strings.Join(clauses, ", ")
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// sortKeyTimeLayout is the layout start times take in a Cursor: RFC 3339 in
+// UTC, to the second as the SQL stores keep them. The zone is explicit, so
+// that Postgres doesn't read the key in its session's time zone, and the
+// fixed width lets keys sort as strings.
+const sortKeyTimeLayout = "2006-01-02T15:04:05Z"
+
+// ListOptions controls the ordering and paging of RacesRepo.List.
+type ListOptions struct {
+	// OrderBy is an AIP-132 order_by, defaulting to advertised_start_time.
+	OrderBy string
+
+	// PageSize is the maximum number of races to return, or 0 for no limit.
+	PageSize int
+
+	// After, when set, resumes listing after the race it was taken from.
+	After *Cursor
+}
+
+// Cursor marks the last race of a page, so the next page can carry on from
+// it using keyset pagination. It is only meaningful for the ordering it was
+// created with.
+type Cursor struct {
+	// Keys holds the last race's value for each order_by field other than id.
+	Keys map[string]interface{} `json:"k,omitempty"`
+
+	// LastID is the id of the last race, breaking ties between races which
+	// share the same sort keys.
+	LastID int64 `json:"id"`
+}
+
+// value returns the cursor's value for the given sort field.
+func (c *Cursor) value(field string) (interface{}, error) {
+	if field == "id" {
+		return c.LastID, nil
+	}
+
+	v, ok := c.Keys[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: page token does not match order_by", ErrInvalidArgument)
+	}
+
+	// Cursors decoded from JSON carry numbers as json.Number or float64.
+	switch n := v.(type) {
+	case json.Number:
+		return n.Int64()
+	case float64:
+		return int64(n), nil
+	}
+
+	return v, nil
+}
+
+// keysetClause builds a WHERE clause selecting the races which sort after the
+// cursor. For terms (a, b, id) this expands to:
+//
+//	a > ? OR (a = ? AND b > ?) OR (a = ? AND b = ? AND id > ?)
+//
+// with > swapped for < on descending terms.
+func (r *racesRepo) keysetClause(terms []orderTerm, after *Cursor) (string, []interface{}, error) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	for i, term := range terms {
+		var (
+			parts    []string
+			termArgs []interface{}
+		)
+
+		for _, prev := range terms[:i] {
+			v, err := after.value(prev.field)
+			if err != nil {
+				return "", nil, err
+			}
+
+			parts = append(parts, r.orderExpr(prev.field)+" = "+r.orderParam(prev.field))
+			termArgs = append(termArgs, v)
+		}
+
+		v, err := after.value(term.field)
+		if err != nil {
+			return "", nil, err
+		}
+
+		op := " > "
+		if term.desc {
+			op = " < "
+		}
+
+		parts = append(parts, r.orderExpr(term.field)+op+r.orderParam(term.field))
+		termArgs = append(termArgs, v)
+
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+		args = append(args, termArgs...)
+	}
+
+	return "(" + strings.Join(clauses, " OR ") + ")", args, nil
+}
+
+// paginate trims races, which may hold one more than pageSize, down to a
+// single page and returns the cursor for the following page, if any.
+func paginate(races []*racing.Race, terms []orderTerm, pageSize int) ([]*racing.Race, *Cursor, error) {
+	if pageSize <= 0 || len(races) <= pageSize {
+		return races, nil, nil
+	}
+
+	races = races[:pageSize]
+
+	return races, cursorFor(races[len(races)-1], terms), nil
+}
+
+// cursorFor builds a cursor positioned at the given race.
+func cursorFor(race *racing.Race, terms []orderTerm) *Cursor {
+	cursor := &Cursor{LastID: race.Id}
+
+	for _, term := range terms {
+		if term.field == "id" {
+			continue
+		}
+
+		if cursor.Keys == nil {
+			cursor.Keys = make(map[string]interface{}, len(terms))
+		}
+
+		cursor.Keys[term.field] = sortKey(race, term.field)
+	}
+
+	return cursor
+}
+
+// sortKey returns the value a race is sorted on for the given field, in the
+// form it is compared in SQL.
+func sortKey(race *racing.Race, field string) interface{} {
+	switch field {
+	case "meeting_id":
+		return race.MeetingId
+	case "name":
+		return race.Name
+	case "number":
+		return race.Number
+	case "visible":
+		return race.Visible
+	case "advertised_start_time":
+		return race.AdvertisedStartTime.AsTime().UTC().Format(sortKeyTimeLayout)
+	}
+
+	return race.Id
+}
@@ -2,6 +2,12 @@ package db
 
 const (
 	racesList = "list"
+	racesGet  = "get"
+
+	meetingsList = "list"
+	meetingsGet  = "get"
+
+	runnersList = "list"
 )
 
 func getRaceQueries() map[string]string {
@@ -13,8 +19,63 @@ func getRaceQueries() map[string]string {
 				name, 
 				number, 
 				visible, 
-				advertised_start_time 
+				advertised_start_time, 
+				version 
+			FROM races
+		`,
+		racesGet: `
+			SELECT 
+				id, 
+				meeting_id, 
+				name, 
+				number, 
+				visible, 
+				advertised_start_time, 
+				version 
 			FROM races
+			WHERE id = ?
+		`,
+	}
+}
+
+func getMeetingQueries() map[string]string {
+	return map[string]string{
+		meetingsList: `
+			SELECT 
+				id, 
+				venue, 
+				country, 
+				race_type, 
+				date 
+			FROM meetings
+		`,
+		meetingsGet: `
+			SELECT 
+				id, 
+				venue, 
+				country, 
+				race_type, 
+				date 
+			FROM meetings
+			WHERE id = ?
+		`,
+	}
+}
+
+func getRunnerQueries() map[string]string {
+	return map[string]string{
+		runnersList: `
+			SELECT 
+				id, 
+				race_id, 
+				barrier, 
+				saddle_cloth_number, 
+				name, 
+				jockey, 
+				trainer, 
+				weight, 
+				scratched 
+			FROM runners
 		`,
 	}
 }
@@ -1,59 +1,423 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/golang/protobuf/ptypes"
-	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"git.neds.sh/matty/entain/racing/proto/racing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
 )
 
 // RacesRepo provides repository access to races.
 type RacesRepo interface {
-	// Init will initialise our races repository.
-	Init() error
+	// List will return a page of races matching filter, ordered and paged
+	// according to opts. The returned cursor is nil once there are no more
+	// races to fetch.
+	List(ctx context.Context, filter *racing.ListRacesRequestFilter, opts ListOptions) ([]*racing.Race, *Cursor, error)
 
-	// List will return a list of races.
-	List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error)
+	// Get will return a single race by its ID, or ErrNotFound if no such race exists.
+	Get(id int64) (*racing.Race, error)
+
+	// Create will insert a new race, returning it with its assigned ID.
+	Create(race *racing.Race) (*racing.Race, error)
+
+	// Update will set the named fields of an existing race from race,
+	// returning the updated race, or ErrNotFound if no such race exists. When
+	// race has an etag, ErrEtagMismatch is returned unless it is current.
+	Update(race *racing.Race, fields []string) (*racing.Race, error)
+
+	// Delete will remove a race along with its runners, or return
+	// ErrNotFound if no such race exists. When etag is non-empty,
+	// ErrEtagMismatch is returned unless it is current.
+	Delete(id int64, etag string) error
+
+	// Subscribe registers for changes to races. A non-zero after resumes from
+	// that sequence, if the changes since are still held.
+	Subscribe(after uint64) *Subscription
+
+	// WatchClosures publishes a ChangeClosed for each race as its advertised
+	// start time passes, checking every interval until ctx is done.
+	WatchClosures(ctx context.Context, interval time.Duration)
 }
 
-type racesRepo struct {
-	db   *sql.DB
-	init sync.Once
+// raceUpdateColumns maps the Race fields which may be updated onto their
+// SQL columns.
+var raceUpdateColumns = map[string]string{
+	"meeting_id":            "meeting_id",
+	"name":                  "name",
+	"number":                "number",
+	"visible":               "visible",
+	"advertised_start_time": "advertised_start_time",
 }
 
-// NewRacesRepo creates a new races repository.
-func NewRacesRepo(db *sql.DB) RacesRepo {
-	return &racesRepo{db: db}
+// UpdatableRaceFields lists the Race fields which may be passed to Update.
+func UpdatableRaceFields() []string {
+	fields := make([]string, 0, len(raceUpdateColumns))
+	for field := range raceUpdateColumns {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	return fields
+}
+
+// raceColumnValue returns the value stored in the column for a race field.
+func raceColumnValue(race *racing.Race, field string) interface{} {
+	switch field {
+	case "meeting_id":
+		return race.MeetingId
+	case "name":
+		return race.Name
+	case "number":
+		return race.Number
+	case "visible":
+		return race.Visible
+	case "advertised_start_time":
+		return race.AdvertisedStartTime.AsTime().UTC().Format(time.RFC3339)
+	}
+
+	return nil
 }
 
-// Init prepares the race repository dummy data.
-func (r *racesRepo) Init() error {
-	var err error
+var (
+	// ErrNotFound is returned when a requested race or meeting does not exist.
+	ErrNotFound = errors.New("not found")
+
+	// ErrInvalidArgument is wrapped by errors caused by invalid caller input.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrEtagMismatch is returned when a write is conditional on an etag
+	// which is no longer current.
+	ErrEtagMismatch = errors.New("etag mismatch")
+)
+
+type racesRepo struct {
+	db   *DB
+	now  func() time.Time
+	feed *changeFeed
 
-	r.init.Do(func() {
-		// For test/example purposes, we seed the DB with some dummy races.
-		err = r.seed()
-	})
+	// publishing is held while a write commits and publishes its change.
+	publishing sync.Mutex
+}
 
-	return err
+// NewRacesRepo creates a new races repository. The now clock is used to derive
+// each race's status from its advertised start time.
+func NewRacesRepo(db *DB, now func() time.Time) RacesRepo {
+	return &racesRepo{db: db, now: now, feed: newChangeFeed(now())}
 }
 
-func (r *racesRepo) List(filter *racing.ListRacesRequestFilter) ([]*racing.Race, error) {
+func (r *racesRepo) List(ctx context.Context, filter *racing.ListRacesRequestFilter, opts ListOptions) ([]*racing.Race, *Cursor, error) {
 	var (
 		err   error
 		query string
 		args  []interface{}
 	)
 
+	terms, err := orderTerms(opts.OrderBy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer timeQuery("list")()
+
 	query = getRaceQueries()[racesList]
 
-	query, args = r.applyFilter(query, filter)
+	query, args, err = r.applyFilter(query, filter, terms, opts.After)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query = r.applyOrder(query, terms)
+
+	if opts.PageSize > 0 {
+		// Fetch one extra race so we know whether another page follows.
+		query += " LIMIT ?"
+		args = append(args, opts.PageSize+1)
+	}
+
+	rows, err := r.query(ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, span := tracer.Start(ctx, "scan races")
+	races, err := r.scanRaces(rows)
+	endSpan(span, err, attribute.Int("db.rows", len(races)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return paginate(races, terms, opts.PageSize)
+}
+
+// query runs query within a span, so it shows up in traces of the request
+// which made it.
+func (r *racesRepo) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := tracer.Start(ctx, "query races", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", r.db.Dialect.system),
+		attribute.String("db.statement", query),
+	))
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+
+	return rows, err
+}
+
+func (r *racesRepo) Get(id int64) (*racing.Race, error) {
+	defer timeQuery("get")()
+
+	rows, err := r.db.Query(getRaceQueries()[racesGet], id)
+	if err != nil {
+		return nil, err
+	}
+
+	races, err := r.scanRaces(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(races) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return races[0], nil
+}
+
+func (r *racesRepo) Create(race *racing.Race) (*racing.Race, error) {
+	done := timeQuery("create")
+	id, err := r.insert(
+		`INSERT INTO races(meeting_id, name, number, visible, advertised_start_time) VALUES (?,?,?,?,?)`,
+		race.MeetingId,
+		race.Name,
+		race.Number,
+		race.Visible,
+		race.AdvertisedStartTime.AsTime().UTC().Format(time.RFC3339),
+	)
+	done()
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := r.db.Query(query, args...)
+	created, err := r.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.feed.publish(ChangeCreated, nil, created)
+
+	return created, nil
+}
+
+func (r *racesRepo) Update(race *racing.Race, fields []string) (*racing.Race, error) {
+	var (
+		sets []string
+		args []interface{}
+	)
+
+	for _, field := range fields {
+		column, ok := raceUpdateColumns[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: cannot update field %q", ErrInvalidArgument, field)
+		}
+
+		sets = append(sets, column+" = ?")
+		args = append(args, raceColumnValue(race, field))
+	}
+
+	defer timeQuery("update")()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, err := r.lockRace(tx, race.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if race.Etag != "" && race.Etag != previous.Etag {
+		return nil, ErrEtagMismatch
+	}
+
+	// With nothing to write, the etag still had to match.
+	if len(sets) == 0 {
+		return previous, nil
+	}
+
+	query := `UPDATE races SET ` + strings.Join(sets, ", ") + `, version = version + 1 WHERE id = ?`
+	if _, err := tx.Exec(query, append(args, race.Id)...); err != nil {
+		return nil, err
+	}
+
+	updated, err := r.lockRace(tx, race.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.commit(tx, ChangeUpdated, previous, updated); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (r *racesRepo) Delete(id int64, etag string) error {
+	defer timeQuery("delete")()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	race, err := r.lockRace(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if etag != "" && etag != race.Etag {
+		return ErrEtagMismatch
+	}
+
+	// The race and its runners go in one transaction. Runners go first, as
+	// they reference the race.
+	if _, err := tx.Exec(`DELETE FROM runners WHERE race_id = ?`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM races WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	return r.commit(tx, ChangeDeleted, nil, race)
+}
+
+// lockRace reads a race within tx, locking it against other writers until
+// tx ends, so that what's written and published follows from what was read.
+func (r *racesRepo) lockRace(tx *Tx, id int64) (*racing.Race, error) {
+	rows, err := tx.Query(getRaceQueries()[racesGet]+r.db.Dialect.lockRows, id)
+	if err != nil {
+		return nil, err
+	}
+
+	races, err := r.scanRaces(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(races) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return races[0], nil
+}
+
+// commit commits tx and publishes the change it made. Concurrent writes to
+// a race wait on its lock, so holding commits until their change has been
+// published keeps the feed in the order they were made.
+func (r *racesRepo) commit(tx *Tx, changeType ChangeType, previous, race *racing.Race) error {
+	r.publishing.Lock()
+	defer r.publishing.Unlock()
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.feed.publish(changeType, previous, race)
+
+	return nil
+}
+
+// insert runs an INSERT, returning the ID assigned to the new row.
+func (r *racesRepo) insert(query string, args ...interface{}) (int64, error) {
+	if r.db.Dialect.returningID {
+		var id int64
+		err := r.db.QueryRow(query+" RETURNING id", args...).Scan(&id)
+
+		return id, err
+	}
+
+	result, err := r.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+func (r *racesRepo) Subscribe(after uint64) *Subscription {
+	return r.feed.subscribe(after)
+}
+
+func (r *racesRepo) WatchClosures(ctx context.Context, interval time.Duration) {
+	watchClosures(ctx, interval, r.now, r.feed, r.startedBetween)
+}
+
+// watchClosures publishes a ChangeClosed to feed for each race returned by
+// startedBetween, checking every interval until ctx is done.
+func watchClosures(
+	ctx context.Context,
+	interval time.Duration,
+	now func() time.Time,
+	feed *changeFeed,
+	startedBetween func(since, until time.Time) ([]*racing.Race, error),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	since := now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		until := now()
+
+		races, err := startedBetween(since, until)
+		if err != nil {
+			log.Errorf("failed checking for closed races: %s", err)
+			continue
+		}
+
+		for _, race := range races {
+			open := proto.Clone(race).(*racing.Race)
+			open.Status = racing.Race_OPEN
+
+			feed.publish(ChangeClosed, open, race)
+		}
+
+		since = until
+	}
+}
+
+// startedBetween returns the races advertised to start after since, up to
+// and including until.
+func (r *racesRepo) startedBetween(since, until time.Time) ([]*racing.Race, error) {
+	defer timeQuery("started_between")()
+
+	startTime := r.db.Dialect.time("advertised_start_time")
+	query := getRaceQueries()[racesList] +
+		" WHERE " + startTime + " > " + r.db.Dialect.time("?") +
+		" AND " + startTime + " <= " + r.db.Dialect.time("?")
+
+	rows, err := r.db.Query(query, since.UTC().Format(time.RFC3339), until.UTC().Format(time.RFC3339))
 	if err != nil {
 		return nil, err
 	}
@@ -61,14 +425,24 @@ func (r *racesRepo) List(filter *racing.ListRacesRequestFilter) ([]*racing.Race,
 	return r.scanRaces(rows)
 }
 
-func (r *racesRepo) applyFilter(query string, filter *racing.ListRacesRequestFilter) (string, []interface{}) {
+func (r *racesRepo) applyFilter(query string, filter *racing.ListRacesRequestFilter, terms []orderTerm, after *Cursor) (string, []interface{}, error) {
 	var (
 		clauses []string
 		args    []interface{}
 	)
 
+	if after != nil {
+		clause, cursorArgs, err := r.keysetClause(terms, after)
+		if err != nil {
+			return "", nil, err
+		}
+
+		clauses = append(clauses, clause)
+		args = append(args, cursorArgs...)
+	}
+
 	if filter == nil {
-		return query, args
+		filter = &racing.ListRacesRequestFilter{}
 	}
 
 	if len(filter.MeetingIds) > 0 {
@@ -79,11 +453,57 @@ func (r *racesRepo) applyFilter(query string, filter *racing.ListRacesRequestFil
 		}
 	}
 
+	if filter.Visible != nil {
+		clauses = append(clauses, "visible = ?")
+		args = append(args, *filter.Visible)
+	}
+
+	switch filter.Status {
+	case racing.Race_OPEN:
+		clauses = append(clauses, r.db.Dialect.time("advertised_start_time")+" > "+r.db.Dialect.time("?"))
+		args = append(args, r.now().UTC().Format(time.RFC3339))
+	case racing.Race_CLOSED:
+		clauses = append(clauses, r.db.Dialect.time("advertised_start_time")+" <= "+r.db.Dialect.time("?"))
+		args = append(args, r.now().UTC().Format(time.RFC3339))
+	}
+
 	if len(clauses) != 0 {
 		query += " WHERE " + strings.Join(clauses, " AND ")
 	}
 
-	return query, args
+	return query, args, nil
+}
+
+// MatchesFilter reports whether a race satisfies filter, mirroring the
+// clauses applyFilter adds to queries. Status is taken from the race itself.
+func MatchesFilter(race *racing.Race, filter *racing.ListRacesRequestFilter) bool {
+	if filter == nil {
+		return true
+	}
+
+	if len(filter.MeetingIds) > 0 {
+		var found bool
+		for _, meetingID := range filter.MeetingIds {
+			if race.MeetingId == meetingID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Visible != nil && race.Visible != *filter.Visible {
+		return false
+	}
+
+	if filter.Status != racing.Race_STATUS_UNSPECIFIED && race.Status != filter.Status {
+		return false
+	}
+
+	return true
 }
 
 func (m *racesRepo) scanRaces(
@@ -94,8 +514,9 @@ func (m *racesRepo) scanRaces(
 	for rows.Next() {
 		var race racing.Race
 		var advertisedStart time.Time
+		var version int64
 
-		if err := rows.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart); err != nil {
+		if err := rows.Scan(&race.Id, &race.MeetingId, &race.Name, &race.Number, &race.Visible, &advertisedStart, &version); err != nil {
 			if err == sql.ErrNoRows {
 				return nil, nil
 			}
@@ -109,9 +530,21 @@ func (m *racesRepo) scanRaces(
 		}
 
 		race.AdvertisedStartTime = ts
+		race.Status = raceStatus(advertisedStart, m.now())
+		race.Etag = strconv.FormatInt(version, 10)
 
 		races = append(races, &race)
 	}
 
 	return races, nil
 }
+
+// raceStatus derives a race's status from its advertised start time. Races
+// which have already started are CLOSED.
+func raceStatus(advertisedStart, now time.Time) racing.Race_Status {
+	if advertisedStart.After(now) {
+		return racing.Race_OPEN
+	}
+
+	return racing.Race_CLOSED
+}
@@ -0,0 +1,27 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/db/dbtest"
+)
+
+func TestSQLiteRacesRepo(t *testing.T) {
+	dbtest.TestRacesRepo(t, dbtest.SQLRacesRepo(dbtest.SQLite(t)))
+}
+
+func TestPostgresRacesRepo(t *testing.T) {
+	dbtest.TestRacesRepo(t, dbtest.SQLRacesRepo(dbtest.Postgres(t)))
+}
+
+func TestMemoryRacesRepo(t *testing.T) {
+	dbtest.TestRacesRepo(t, dbtest.MemoryRacesRepo)
+}
+
+func TestCachedRacesRepo(t *testing.T) {
+	dbtest.TestRacesRepo(t, func(t *testing.T, fixtures *db.Fixtures, now func() time.Time) db.RacesRepo {
+		return db.NewCachedRacesRepo(dbtest.MemoryRacesRepo(t, fixtures, now), time.Minute, now)
+	})
+}
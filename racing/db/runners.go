@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+)
+
+// RunnersRepo provides repository access to runners.
+type RunnersRepo interface {
+	// List will return the runners of the given races, in a single query.
+	// Runners are ordered by race then saddle cloth number.
+	List(raceIDs []int64) ([]*racing.Runner, error)
+}
+
+type runnersRepo struct {
+	db *DB
+}
+
+// NewRunnersRepo creates a new runners repository.
+func NewRunnersRepo(db *DB) RunnersRepo {
+	return &runnersRepo{db: db}
+}
+
+func (r *runnersRepo) List(raceIDs []int64) ([]*racing.Runner, error) {
+	if len(raceIDs) == 0 {
+		return nil, nil
+	}
+
+	query := getRunnerQueries()[runnersList] +
+		" WHERE race_id IN (" + strings.Repeat("?,", len(raceIDs)-1) + "?)" +
+		" ORDER BY race_id, saddle_cloth_number"
+
+	args := make([]interface{}, 0, len(raceIDs))
+	for _, raceID := range raceIDs {
+		args = append(args, raceID)
+	}
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.scanRunners(rows)
+}
+
+func (m *runnersRepo) scanRunners(
+	rows *sql.Rows,
+) ([]*racing.Runner, error) {
+	var runners []*racing.Runner
+
+	for rows.Next() {
+		var runner racing.Runner
+
+		if err := rows.Scan(&runner.Id, &runner.RaceId, &runner.Barrier, &runner.SaddleClothNumber, &runner.Name, &runner.Jockey, &runner.Trainer, &runner.Weight, &runner.Scratched); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		runners = append(runners, &runner)
+	}
+
+	return runners, nil
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans recorded around database access. It is resolved
+// through the global provider, so spans are dropped until one is installed.
+var tracer = otel.Tracer("git.neds.sh/matty/entain/racing/db")
+
+// endSpan ends span with attrs, marking it failed if err is non-nil.
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
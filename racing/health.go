@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// healthService implements grpc.health.v1.Health, for both the server as a
+// whole and the racing service. It reports NOT_SERVING until startup has
+// completed, whenever the database can't be reached, and once shutdown has
+// begun.
+type healthService struct {
+	*health.Server
+
+	// serving is 1 while we're reporting SERVING.
+	serving int32
+
+	mu       sync.Mutex
+	stopping chan struct{}
+}
+
+func newHealthService() *healthService {
+	s := &healthService{Server: health.NewServer(), stopping: make(chan struct{})}
+	s.setServing(false)
+
+	return s
+}
+
+// Shutdown reports NOT_SERVING from now on, so load balancers stop sending
+// us requests, and ends open streams so their clients reconnect elsewhere.
+// Unary calls already in flight are left to finish.
+func (s *healthService) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.stopping:
+		return
+	default:
+	}
+
+	atomic.StoreInt32(&s.serving, 0)
+	s.Server.Shutdown()
+	close(s.stopping)
+}
+
+// watch pings the database every interval until ctx is done, reporting
+// whether it could be reached. Startup must have completed before it's
+// called.
+func (s *healthService) watch(ctx context.Context, ping func(context.Context) error, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := ping(pingCtx)
+		cancel()
+
+		serving := err == nil
+		if serving != s.isServing() {
+			if serving {
+				log.Info("database reachable, serving")
+			} else {
+				log.Errorf("failed pinging database, not serving: %s", err)
+			}
+		}
+		s.setServing(serving)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *healthService) setServing(serving bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Once shutting down we stay NOT_SERVING, however the database is.
+	select {
+	case <-s.stopping:
+		return
+	default:
+	}
+
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = healthpb.HealthCheckResponse_SERVING
+		atomic.StoreInt32(&s.serving, 1)
+	} else {
+		atomic.StoreInt32(&s.serving, 0)
+	}
+
+	s.SetServingStatus("", status)
+	s.SetServingStatus(racing.Racing_ServiceDesc.ServiceName, status)
+}
+
+func (s *healthService) isServing() bool {
+	return atomic.LoadInt32(&s.serving) == 1
+}
+
+// unaryReady refuses unary RPCs with Unavailable while we're not serving, so
+// clients retry elsewhere rather than reading a half migrated database.
+// Health checks are always answered.
+func (s *healthService) unaryReady(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.ready(info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// streamReady refuses streaming RPCs while we're not serving, like
+// unaryReady. Streams which are open when shutdown begins are ended with
+// Unavailable, as they'd otherwise hold up the server stopping.
+func (s *healthService) streamReady(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.ready(info.FullMethod); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.stopping:
+			cancel()
+		}
+	}()
+
+	err := handler(srv, &drainingStream{ServerStream: ss, ctx: ctx})
+
+	select {
+	case <-s.stopping:
+		if ss.Context().Err() == nil {
+			return status.Error(codes.Unavailable, "racing service is shutting down, please reconnect")
+		}
+	default:
+	}
+
+	return err
+}
+
+// drainingStream is a server stream whose context is cancelled once shutdown
+// begins.
+type drainingStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *drainingStream) Context() context.Context {
+	return s.ctx
+}
+
+// ready returns an Unavailable error if method can't be served yet.
+func (s *healthService) ready(method string) error {
+	if s.isServing() || strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	return status.Error(codes.Unavailable, "racing service is not serving")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// watchedRacingServer answers GetRace, and holds WatchRaces streams open
+// after a first event until they're cancelled.
+type watchedRacingServer struct {
+	racing.UnimplementedRacingServer
+}
+
+func (watchedRacingServer) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	return &racing.Race{Id: in.Id}, nil
+}
+
+func (watchedRacingServer) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	if err := stream.Send(&racing.WatchRacesResponse{Type: racing.WatchRacesResponse_SNAPSHOT_COMPLETE}); err != nil {
+		return err
+	}
+
+	<-stream.Context().Done()
+
+	return stream.Context().Err()
+}
+
+// serveHealth serves srv and health over an in-memory connection, behind
+// health's interceptors, returning the server and a connection to it.
+func serveHealth(t *testing.T, health *healthService, srv racing.RacingServer) (*grpc.Server, *grpc.ClientConn) {
+	t.Helper()
+
+	ln := bufconn.Listen(1 << 20)
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(health.unaryReady),
+		grpc.ChainStreamInterceptor(health.streamReady),
+	)
+	racing.RegisterRacingServer(server, srv)
+	healthpb.RegisterHealthServer(server, health)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return server, conn
+}
+
+// checkHealth checks the health of both the server and the racing service
+// is want.
+func checkHealth(t *testing.T, conn *grpc.ClientConn, want healthpb.HealthCheckResponse_ServingStatus) {
+	t.Helper()
+
+	client := healthpb.NewHealthClient(conn)
+	for _, service := range []string{"", racing.Racing_ServiceDesc.ServiceName} {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("checking %q: %s", service, err)
+		}
+
+		if resp.Status != want {
+			t.Errorf("health of %q = %s, want %s", service, resp.Status, want)
+		}
+	}
+}
+
+// checkCalls checks unary and streaming racing calls fail with code, or
+// succeed for codes.OK.
+func checkCalls(t *testing.T, conn *grpc.ClientConn, code codes.Code) {
+	t.Helper()
+
+	client := racing.NewRacingClient(conn)
+
+	_, err := client.GetRace(context.Background(), &racing.GetRaceRequest{Id: 1})
+	if status.Code(err) != code {
+		t.Errorf("GetRace: %v, want %s", err, code)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.WatchRaces(ctx, &racing.WatchRacesRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != code {
+		t.Errorf("WatchRaces: %v, want %s", err, code)
+	}
+}
+
+func TestHealthStartup(t *testing.T) {
+	health := newHealthService()
+	_, conn := serveHealth(t, health, watchedRacingServer{})
+
+	// Until startup completes, only health checks are answered.
+	checkHealth(t, conn, healthpb.HealthCheckResponse_NOT_SERVING)
+	checkCalls(t, conn, codes.Unavailable)
+
+	health.setServing(true)
+
+	checkHealth(t, conn, healthpb.HealthCheckResponse_SERVING)
+	checkCalls(t, conn, codes.OK)
+}
+
+func TestHealthWatch(t *testing.T) {
+	health := newHealthService()
+	_, conn := serveHealth(t, health, watchedRacingServer{})
+
+	var down atomic.Bool
+	ping := func(context.Context) error {
+		if down.Load() {
+			return errors.New("database is down")
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watch, err := healthpb.NewHealthClient(conn).Watch(ctx, &healthpb.HealthCheckRequest{Service: racing.Racing_ServiceDesc.ServiceName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expect waits for the health of the racing service to change to want.
+	expect := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+
+		for {
+			resp, err := watch.Recv()
+			if err != nil {
+				t.Fatalf("waiting for %s: %s", want, err)
+			}
+			if resp.Status == want {
+				return
+			}
+		}
+	}
+
+	expect(healthpb.HealthCheckResponse_NOT_SERVING)
+
+	go health.watch(ctx, ping, 10*time.Millisecond)
+
+	expect(healthpb.HealthCheckResponse_SERVING)
+	checkCalls(t, conn, codes.OK)
+
+	down.Store(true)
+	expect(healthpb.HealthCheckResponse_NOT_SERVING)
+	checkHealth(t, conn, healthpb.HealthCheckResponse_NOT_SERVING)
+	checkCalls(t, conn, codes.Unavailable)
+
+	down.Store(false)
+	expect(healthpb.HealthCheckResponse_SERVING)
+	checkCalls(t, conn, codes.OK)
+}
+
+func TestHealthShutdown(t *testing.T) {
+	health := newHealthService()
+	_, conn := serveHealth(t, health, watchedRacingServer{})
+	health.setServing(true)
+
+	stream, err := racing.NewRacingClient(conn).WatchRaces(context.Background(), &racing.WatchRacesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	health.Shutdown()
+	health.Shutdown()
+
+	// The open stream is ended, so its client reconnects elsewhere.
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("open stream ended with %v, want %s", err, codes.Unavailable)
+	}
+
+	checkHealth(t, conn, healthpb.HealthCheckResponse_NOT_SERVING)
+	checkCalls(t, conn, codes.Unavailable)
+
+	// A reachable database doesn't bring us back.
+	health.setServing(true)
+
+	checkHealth(t, conn, healthpb.HealthCheckResponse_NOT_SERVING)
+	checkCalls(t, conn, codes.Unavailable)
+}
@@ -1,58 +1,445 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/rand"
 	"flag"
+	"fmt"
+	"git.neds.sh/matty/entain/internal/platform/metrics"
+	"git.neds.sh/matty/entain/internal/platform/tlsreload"
+	"git.neds.sh/matty/entain/internal/platform/tracing"
 	"git.neds.sh/matty/entain/racing/db"
 	"git.neds.sh/matty/entain/racing/proto/racing"
 	"git.neds.sh/matty/entain/racing/service"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 var (
-	grpcEndpoint = flag.String("grpc-endpoint", "localhost:9000", "gRPC server endpoint")
+	grpcEndpoint    = flag.String("grpc-endpoint", ":9000", "gRPC server endpoint")
+	dbDriver        = flag.String("db-driver", "sqlite3", "Database driver races are stored with: sqlite3, postgres, or memory for a throwaway in-memory store")
+	dbDSN           = flag.String("db-dsn", "./db/racing.db", "Data source name of the database, e.g. a file for sqlite3 or a URL for postgres")
+	pageTokenKey    = flag.String("page-token-key", "", "Secret used to sign ListRaces page tokens, shared by every replica. When empty a random key is generated, so page tokens stop working after a restart and across replicas")
+	seed            = flag.Bool("seed", false, "Seed the database with fixtures on start")
+	seedValue       = flag.Int64("seed-value", 0, "Random seed for generated fixtures, for reproducible race cards (random when 0)")
+	seedDate        = flag.String("seed-date", "", "Day generated fixtures are scheduled around, as YYYY-MM-DD, so --seed-value reproduces the same card whenever it's run (today when empty)")
+	seedFile        = flag.String("seed-file", "", "JSON or YAML file of fixtures to seed, instead of generating them (implies --seed)")
+	cache           = flag.Bool("cache", true, "Cache ListRaces and GetRace results, invalidated by any write")
+	cacheTTL        = flag.Duration("cache-ttl", 5*time.Second, "How long cached races are served for")
+	metricsEndpoint = flag.String("metrics-endpoint", "localhost:9100", "HTTP endpoint serving Prometheus metrics at /metrics")
+	traceExporter   = flag.String("trace-exporter", "none", "Where spans are exported: none, stdout, or otlp")
+	otlpEndpoint    = flag.String("otlp-endpoint", "", "OTLP gRPC collector endpoint (OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317 when empty)")
+	otlpInsecure    = flag.Bool("otlp-insecure", false, "Export spans to the OTLP collector without TLS")
+	auth            = flag.Bool("auth", false, "Require the caller identity forwarded by the gateway, and enforce its scopes")
+	rateLimitsPath  = flag.String("rate-limits", "", "YAML or JSON file of how often each caller may call each method (unlimited when empty)")
+	tlsCert         = flag.String("tls-cert", "", "PEM certificate to serve gRPC over TLS with, reloaded when it changes")
+	tlsKey          = flag.String("tls-key", "", "PEM private key of --tls-cert")
+	tlsClientCA     = flag.String("tls-client-ca", "", "PEM CA bundle which clients must present a certificate signed by (mutual TLS), reloaded when it changes")
+	shutdownDelay   = flag.Duration("shutdown-delay", 0, "How long to report NOT_SERVING on SIGINT or SIGTERM before draining, for load balancers to notice")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 15*time.Second, "How long in-flight requests are given to finish on shutdown before they're cut off")
+)
+
+const (
+	// closureCheckInterval is how often we check for races which have
+	// started, publishing their transition to CLOSED to watchers.
+	closureCheckInterval = time.Second
+
+	// healthCheckInterval is how often the database is pinged, to report
+	// whether we're able to serve.
+	healthCheckInterval = 5 * time.Second
+
+	// seedDateLayout is the layout of --seed-date.
+	seedDateLayout = "2006-01-02"
 )
 
 func main() {
 	flag.Parse()
 
+	if err := loadConfig(); err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := migrate(flag.Args()[1:]); err != nil {
+			log.Fatalf("failed migrating database: %s", err)
+		}
+
+		return
+	}
+
 	if err := run(); err != nil {
 		log.Fatalf("failed running grpc server: %s", err)
 	}
 }
 
 func run() error {
-	conn, err := net.Listen("tcp", ":9000")
+	// ctx is done once we're asked to stop.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	logConfig()
+
+	conn, err := net.Listen("tcp", *grpcEndpoint)
 	if err != nil {
 		return err
 	}
 
-	racingDB, err := sql.Open("sqlite3", "./db/racing.db")
+	metricsConn, err := net.Listen("tcp", *metricsEndpoint)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed listening for metrics: %w", err)
+	}
+
+	metricsServer := metrics.Serve(metricsConn)
+	defer metricsServer.Close()
+
+	shutdownTracing, err := tracing.Setup(ctx, "racing", tracing.Config{
+		Exporter:     *traceExporter,
+		OTLPEndpoint: *otlpEndpoint,
+		OTLPInsecure: *otlpInsecure,
+	})
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("failed flushing spans: %s", err)
+		}
+	}()
 
-	racesRepo := db.NewRacesRepo(racingDB)
-	if err := racesRepo.Init(); err != nil {
+	store, err := openStore()
+	if err != nil {
 		return err
 	}
 
-	grpcServer := grpc.NewServer()
+	racesRepo := store.races
+	if *cache {
+		racesRepo = db.NewCachedRacesRepo(racesRepo, *cacheTTL, time.Now)
+	}
+
+	tokenKey, err := loadPageTokenKey()
+	if err != nil {
+		return err
+	}
+
+	healthServer := newHealthService()
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor(), unaryMetrics, healthServer.unaryReady}
+	streamInterceptors := []grpc.StreamServerInterceptor{otelgrpc.StreamServerInterceptor(), streamMetrics, healthServer.streamReady}
+
+	if *auth {
+		unaryInterceptors = append(unaryInterceptors, unaryAuth)
+		streamInterceptors = append(streamInterceptors, streamAuth)
+	} else {
+		log.Warn("no --auth set, every caller can read and write all races")
+	}
+
+	// Rate limits apply once callers are authenticated, as with --auth they
+	// are told apart by the identity the gateway forwards.
+	if *rateLimitsPath != "" {
+		limits, err := loadRateLimits(*rateLimitsPath, *auth, time.Now)
+		if err != nil {
+			return err
+		}
+
+		unaryInterceptors = append(unaryInterceptors, limits.unaryRateLimit)
+		streamInterceptors = append(streamInterceptors, limits.streamRateLimit)
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+	}
+
+	if *tlsCert != "" {
+		creds, err := serverCredentials(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			return err
+		}
+
+		serverOpts = append(serverOpts, creds)
+	}
+
+	grpcServer := grpc.NewServer(serverOpts...)
 
 	racing.RegisterRacingServer(
 		grpcServer,
 		service.NewRacingService(
 			racesRepo,
+			store.meetings,
+			store.runners,
+			tokenKey,
 		),
 	)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
 
 	log.Infof("gRPC server listening on: %s", *grpcEndpoint)
 
-	if err := grpcServer.Serve(conn); err != nil {
+	// We serve while migrating and seeding, so health checks can report that
+	// we aren't ready yet rather than going unanswered.
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(conn)
+	}()
+
+	if err := store.prepare(); err != nil {
+		grpcServer.Stop()
+		store.close()
+		return err
+	}
+
+	go racesRepo.WatchClosures(ctx, closureCheckInterval)
+	go healthServer.watch(ctx, store.ping, healthCheckInterval)
+
+	select {
+	case err := <-served:
+		store.close()
 		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("shutting down")
+
+	drain(healthServer, grpcServer, metricsServer, *shutdownDelay, *shutdownTimeout)
+
+	return store.close()
+}
+
+// drain stops serving once we've been asked to stop. We stop reporting
+// SERVING first, so load balancers stop sending us new requests before we
+// stop accepting them, then give in-flight RPCs until timeout to finish.
+// Metrics are served until the end, so the drain itself can be watched.
+func drain(health *healthService, server *grpc.Server, metricsServer *http.Server, delay, timeout time.Duration) {
+	health.Shutdown()
+	time.Sleep(delay)
+
+	gracefulStop(server, timeout)
+	metrics.Shutdown(metricsServer, timeout)
+}
+
+// gracefulStop stops server once its in-flight RPCs have finished, or cuts
+// them off if they're still running after timeout.
+func gracefulStop(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+	case <-timer.C:
+		log.Warnf("in-flight requests still running after %s, stopping anyway", timeout)
+		server.Stop()
+		<-stopped
+	}
+}
+
+// serverCredentials serves gRPC over TLS with the given certificate,
+// requiring clients to present one signed by clientCAFile when it's set.
+func serverCredentials(certFile, keyFile, clientCAFile string) (grpc.ServerOption, error) {
+	files, err := tlsreload.Load(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.Creds(credentials.NewTLS(tlsreload.ServerConfig(files, "h2"))), nil
+}
+
+// store is the set of repositories races are served from.
+type store struct {
+	meetings db.MeetingsRepo
+	races    db.RacesRepo
+	runners  db.RunnersRepo
+
+	// sql is the database behind the repositories, or nil when they're held
+	// in memory.
+	sql *db.DB
+	mem *db.MemoryDB
+}
+
+// openStore opens the repositories for --db-driver. They aren't ready to
+// serve from until prepare has been called.
+func openStore() (*store, error) {
+	if *dbDriver == db.MemoryDriver {
+		mem := db.NewMemoryDB()
+
+		return &store{
+			meetings: db.NewMemoryMeetingsRepo(mem),
+			races:    db.NewMemoryRacesRepo(mem, time.Now),
+			runners:  db.NewMemoryRunnersRepo(mem),
+			mem:      mem,
+		}, nil
+	}
+
+	racingDB, err := db.Open(*dbDriver, *dbDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	return &store{
+		meetings: db.NewMeetingsRepo(racingDB),
+		races:    db.NewRacesRepo(racingDB, time.Now),
+		runners:  db.NewRunnersRepo(racingDB),
+		sql:      racingDB,
+	}, nil
+}
+
+// prepare migrates and seeds the store as asked.
+func (s *store) prepare() error {
+	seeding := *seed || *seedFile != ""
+
+	if s.mem != nil {
+		if !seeding {
+			return nil
+		}
+
+		fixtures, err := loadFixtures()
+		if err != nil {
+			return err
+		}
+
+		return s.mem.Seed(fixtures)
+	}
+
+	// Pending migrations are applied on start, but a database migrated by a
+	// newer release is left alone rather than served from.
+	if err := db.NewMigrator(s.sql).Up(); err != nil {
+		return err
+	}
+
+	if !seeding {
+		return nil
+	}
+
+	fixtures, err := loadFixtures()
+	if err != nil {
+		return err
+	}
+
+	return db.Seed(s.sql, fixtures)
+}
+
+// close closes the database behind the store.
+func (s *store) close() error {
+	if s.sql == nil {
+		return nil
+	}
+
+	return s.sql.Close()
+}
+
+// ping checks the store can be reached.
+func (s *store) ping(ctx context.Context) error {
+	if s.sql == nil {
+		return nil
+	}
+
+	return s.sql.PingContext(ctx)
+}
+
+// loadFixtures returns the fixtures to seed, either loaded from --seed-file
+// or generated from --seed-value.
+func loadFixtures() (*db.Fixtures, error) {
+	if *seedFile != "" {
+		log.Infof("seeding database from %s", *seedFile)
+
+		return db.LoadFixtures(*seedFile)
+	}
+
+	value := *seedValue
+	if value == 0 {
+		value = time.Now().UnixNano()
+	}
+
+	day := time.Now()
+	if *seedDate != "" {
+		// Checked by validateConfig.
+		day, _ = time.Parse(seedDateLayout, *seedDate)
+	}
+
+	log.Infof("seeding database with --seed-value=%d --seed-date=%s", value, day.UTC().Format(seedDateLayout))
+
+	return db.GenerateFixtures(value, day), nil
+}
+
+// loadPageTokenKey returns the key for signing page tokens. Without a
+// configured key a random one is generated, so tokens won't survive a restart
+// or work across replicas.
+func loadPageTokenKey() ([]byte, error) {
+	if *pageTokenKey != "" {
+		return []byte(*pageTokenKey), nil
+	}
+
+	log.Warn("no --page-token-key set, page tokens will only be valid for this process")
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// migrate runs the "migrate up|down|status" subcommand.
+func migrate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s migrate up|down|status", os.Args[0])
+	}
+
+	if *dbDriver == db.MemoryDriver {
+		return fmt.Errorf("the %s driver has no schema to migrate", db.MemoryDriver)
+	}
+
+	racingDB, err := db.Open(*dbDriver, *dbDSN)
+	if err != nil {
+		return err
+	}
+	defer racingDB.Close()
+
+	migrator := db.NewMigrator(racingDB)
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up()
+	case "down":
+		err = migrator.Down()
+	case "status":
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	statuses, err := migrator.Status()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "-"
+		if !status.AppliedAt.IsZero() {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%04d\t%s\t%s\t%s\n", status.Version, status.Name, status.State, appliedAt)
 	}
 
-	return nil
+	return w.Flush()
 }
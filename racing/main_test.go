@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/metrics"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// blockingRacingServer holds GetRace calls until they're released.
+type blockingRacingServer struct {
+	racing.UnimplementedRacingServer
+
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s blockingRacingServer) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	s.entered <- struct{}{}
+
+	select {
+	case <-s.release:
+		return &racing.Race{Id: in.Id}, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// drainTest is a racing server, with metrics, with a GetRace call in flight.
+type drainTest struct {
+	health  *healthService
+	conn    healthpb.HealthClient
+	srv     blockingRacingServer
+	metrics string
+
+	// inFlight receives the result of the call in flight.
+	inFlight chan error
+
+	drain func(delay, timeout time.Duration)
+}
+
+func newDrainTest(t *testing.T) *drainTest {
+	t.Helper()
+
+	health := newHealthService()
+	health.setServing(true)
+
+	srv := blockingRacingServer{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	server, conn := serveHealth(t, health, srv)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsServer := metrics.Serve(ln)
+	t.Cleanup(func() { metricsServer.Close() })
+
+	inFlight := make(chan error, 1)
+	go func() {
+		_, err := racing.NewRacingClient(conn).GetRace(context.Background(), &racing.GetRaceRequest{Id: 1})
+		inFlight <- err
+	}()
+	<-srv.entered
+
+	return &drainTest{
+		health:   health,
+		conn:     healthpb.NewHealthClient(conn),
+		srv:      srv,
+		metrics:  "http://" + ln.Addr().String() + "/metrics",
+		inFlight: inFlight,
+		drain: func(delay, timeout time.Duration) {
+			drain(health, server, metricsServer, delay, timeout)
+		},
+	}
+}
+
+// scrape returns whether metrics could be scraped.
+func (d *drainTest) scrape() bool {
+	resp, err := http.Get(d.metrics)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+func TestDrain(t *testing.T) {
+	d := newDrainTest(t)
+
+	drained := make(chan struct{})
+	go func() {
+		d.drain(50*time.Millisecond, 5*time.Second)
+		close(drained)
+	}()
+
+	// Health checks fail first, and are still answered while the in-flight
+	// call holds up the drain.
+	for {
+		resp, err := d.conn.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == healthpb.HealthCheckResponse_NOT_SERVING {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The in-flight call is waited for, and metrics served meanwhile.
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-drained:
+		t.Fatal("drained with a call in flight")
+	default:
+	}
+	if !d.scrape() {
+		t.Error("metrics not served while draining")
+	}
+
+	close(d.srv.release)
+	if err := <-d.inFlight; err != nil {
+		t.Errorf("in-flight call: %s, want it to finish", err)
+	}
+
+	<-drained
+	if d.scrape() {
+		t.Error("metrics still served once drained")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	d := newDrainTest(t)
+	defer close(d.srv.release)
+
+	start := time.Now()
+	d.drain(0, 50*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("drained after %s, want the in-flight call cut off", elapsed)
+	}
+
+	// The call is cut off rather than left to finish.
+	if err := <-d.inFlight; status.Code(err) != codes.Unavailable && status.Code(err) != codes.Canceled {
+		t.Errorf("in-flight call: %v, want it cut off", err)
+	}
+
+	if d.scrape() {
+		t.Error("metrics still served once drained")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// grpcRequests counts completed RPCs, by method and status code.
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "racing_grpc_requests_total",
+		Help: "Completed gRPC requests, by method and status code.",
+	}, []string{"method", "code"})
+
+	// grpcDuration times unary RPCs. Streams are left out, as they last for
+	// as long as the client keeps watching.
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "racing_grpc_request_duration_seconds",
+		Help:    "Time taken to handle unary gRPC requests, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// unaryMetrics records the count, status and latency of unary RPCs.
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, errorCode(err)).Inc()
+
+	return resp, err
+}
+
+// streamMetrics records the count and status of streaming RPCs.
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, ss)
+
+	grpcRequests.WithLabelValues(info.FullMethod, errorCode(err)).Inc()
+
+	return err
+}
+
+// errorCode returns the name of the status code an RPC ended with. Handlers
+// which return their context's error are reported as cancelled or timed out,
+// rather than Unknown.
+func errorCode(err error) string {
+	if s, ok := status.FromError(err); ok {
+		return s.Code().String()
+	}
+
+	return status.FromContextError(err).Code().String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: "OK"},
+		{err: status.Error(codes.NotFound, "race 1 not found"), want: "NotFound"},
+		{err: status.Error(codes.ResourceExhausted, "slow down"), want: "ResourceExhausted"},
+		{err: context.Canceled, want: "Canceled"},
+		{err: context.DeadlineExceeded, want: "DeadlineExceeded"},
+		{err: fmt.Errorf("failed listing races: %w", context.Canceled), want: "Canceled"},
+		{err: errors.New("boom"), want: "Unknown"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprint(tt.err), func(t *testing.T) {
+			if got := errorCode(tt.err); got != tt.want {
+				t.Errorf("errorCode(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnaryMetrics(t *testing.T) {
+	const method = "/racing.Racing/TestUnaryMetrics"
+
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{err: nil, code: "OK"},
+		{err: status.Error(codes.NotFound, "race 1 not found"), code: "NotFound"},
+		{err: context.Canceled, code: "Canceled"},
+	}
+
+	timed := histogramCount(t, method)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.code, func(t *testing.T) {
+			requests := grpcRequests.WithLabelValues(method, tt.code)
+			before := testutil.ToFloat64(requests)
+
+			resp, err := unaryMetrics(context.Background(), "request", &grpc.UnaryServerInfo{FullMethod: method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					return "response", tt.err
+				})
+
+			// The call passes through untouched.
+			if resp != "response" || err != tt.err {
+				t.Errorf("unaryMetrics = %v, %v, want response, %v", resp, err, tt.err)
+			}
+
+			if got := testutil.ToFloat64(requests) - before; got != 1 {
+				t.Errorf("%s %s requests counted %v times, want once", method, tt.code, got)
+			}
+		})
+	}
+
+	// Every call is timed, whatever its outcome.
+	if got := histogramCount(t, method) - timed; got != uint64(len(tests)) {
+		t.Errorf("%s timed %d times, want %d", method, got, len(tests))
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	const method = "/racing.Racing/TestStreamMetrics"
+
+	requests := grpcRequests.WithLabelValues(method, "Unavailable")
+	before := testutil.ToFloat64(requests)
+
+	want := status.Error(codes.Unavailable, "racing service is shutting down")
+	err := streamMetrics(nil, nil, &grpc.StreamServerInfo{FullMethod: method}, func(srv interface{}, stream grpc.ServerStream) error {
+		return want
+	})
+	if err != want {
+		t.Errorf("streamMetrics = %v, want %v", err, want)
+	}
+
+	if got := testutil.ToFloat64(requests) - before; got != 1 {
+		t.Errorf("%s Unavailable streams counted %v times, want once", method, got)
+	}
+
+	// Streams last as long as the client watches, so aren't timed.
+	if got := histogramCount(t, method); got != 0 {
+		t.Errorf("%s timed %d times, want none", method, got)
+	}
+}
+
+// histogramCount returns how many durations have been recorded for method.
+func histogramCount(t *testing.T, method string) uint64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "racing_grpc_request_duration_seconds" {
+			continue
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "method" && label.GetValue() == method {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/ratelimit"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"gopkg.in/yaml.v3"
+)
+
+// rateLimitsFile is the YAML or JSON file rate limits are read from. Methods
+// are keyed by their full name, e.g. "/racing.Racing/ListRaces".
+type rateLimitsFile struct {
+	Default *ratelimit.Limit           `yaml:"default"`
+	Methods map[string]ratelimit.Limit `yaml:"methods"`
+}
+
+// rateLimits limits how often each caller may call each method, with a token
+// bucket per caller for every method with its own limit, and one shared by
+// the rest. It protects the service from callers which don't go through the
+// gateway, so its limits should allow for the gateway's.
+type rateLimits struct {
+	def     *ratelimit.Limit
+	methods map[string]ratelimit.Limit
+	limiter *ratelimit.Limiter
+
+	// bySubject is whether callers are told apart by the identity the
+	// gateway forwards, which can only be trusted with --auth, rather than
+	// their address.
+	bySubject bool
+}
+
+// loadRateLimits reads rate limits from the file at path.
+func loadRateLimits(path string, bySubject bool, now func() time.Time) (*rateLimits, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rateLimitsFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed parsing rate limits %s: %w", path, err)
+	}
+
+	if file.Default != nil {
+		if err := file.Default.Validate(); err != nil {
+			return nil, fmt.Errorf("default rate limit in %s: %w", path, err)
+		}
+	}
+
+	for method, limit := range file.Methods {
+		if _, ok := methodScopes[method]; !ok {
+			return nil, fmt.Errorf("unknown rate limited method %q in %s", method, path)
+		}
+
+		if err := limit.Validate(); err != nil {
+			return nil, fmt.Errorf("rate limit of %s in %s: %w", method, path, err)
+		}
+	}
+
+	return &rateLimits{def: file.Default, methods: file.Methods, limiter: ratelimit.New(now), bySubject: bySubject}, nil
+}
+
+// unaryRateLimit refuses unary RPCs with ResourceExhausted once the caller
+// has used up its limit.
+func (l *rateLimits) unaryRateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := l.take(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// streamRateLimit rate limits opening streams, like unaryRateLimit.
+func (l *rateLimits) streamRateLimit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := l.take(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+// take takes a token for a call to method, telling the caller when to retry
+// if there are none left. Health checks go unlimited, so probes are always
+// answered.
+func (l *rateLimits) take(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, "/"+healthpb.Health_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+
+	limit, ok := l.methods[method]
+	if !ok {
+		if l.def == nil {
+			return nil
+		}
+
+		// Methods without their own limit share the default bucket.
+		limit, method = *l.def, ""
+	}
+
+	q := l.limiter.Take(l.caller(ctx)+" "+method, limit)
+	if !q.Allowed {
+		return ratelimit.Error(q.RetryAfter)
+	}
+
+	return nil
+}
+
+// caller returns who an RPC is rate limited as.
+func (l *rateLimits) caller(ctx context.Context) string {
+	if l.bySubject {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if subjects := md.Get(subjectMetadata); len(subjects) == 1 {
+			return "subject:" + subjects[0]
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+
+	return "ip:" + host
+}
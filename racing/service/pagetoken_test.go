@@ -0,0 +1,177 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	codec := pageTokenCodec{[]byte("secret")}
+	cursor := &db.Cursor{
+		Keys:   map[string]interface{}{"advertised_start_time": "2030-01-01T12:00:00Z", "number": 3},
+		LastID: 42,
+	}
+
+	token, err := codec.encode("query", cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := codec.decode("query", token)
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	if got.LastID != 42 {
+		t.Errorf("LastID = %d, want 42", got.LastID)
+	}
+	if got.Keys["advertised_start_time"] != "2030-01-01T12:00:00Z" {
+		t.Errorf("advertised_start_time = %v, want 2030-01-01T12:00:00Z", got.Keys["advertised_start_time"])
+	}
+	// Numbers are kept exact rather than widened to float64.
+	if got.Keys["number"] != json.Number("3") {
+		t.Errorf("number = %#v, want json.Number 3", got.Keys["number"])
+	}
+}
+
+func TestPageTokenRejected(t *testing.T) {
+	codec := pageTokenCodec{[]byte("secret")}
+
+	token, err := codec.encode("query", &db.Cursor{LastID: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig := splitToken(t, token)
+
+	// sign returns a token for payload signed with the codec's key.
+	sign := func(payload string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+			base64.RawURLEncoding.EncodeToString(codec.sign([]byte(payload)))
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		token string
+	}{
+		{"empty", "query", ""},
+		{"without a signature", "query", payload},
+		{"with extra parts", "query", token + ".extra"},
+		{"payload not base64", "query", "!!!." + sig},
+		{"signature not base64", "query", payload + ".!!!"},
+		{"tampered payload", "query", base64.RawURLEncoding.EncodeToString([]byte(`{"q":"query","c":{"id":1}}`)) + "." + sig},
+		{"tampered signature", "query", payload + "." + base64.RawURLEncoding.EncodeToString([]byte("forged"))},
+		{"signed with another key", "query", mustEncode(t, pageTokenCodec{[]byte("other")}, "query", &db.Cursor{LastID: 42})},
+		{"for another query", "other query", token},
+		{"payload not JSON", "query", sign("not json")},
+		{"payload without a cursor", "query", sign(`{"q":"query"}`)},
+		{"cursor of the wrong type", "query", sign(`{"q":"query","c":"42"}`)},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if cursor, err := codec.decode(tt.query, tt.token); err != errInvalidPageToken {
+				t.Errorf("decode = %v, %v, want %v", cursor, err, errInvalidPageToken)
+			}
+		})
+	}
+}
+
+func TestListRacesQuery(t *testing.T) {
+	base := &racing.ListRacesRequest{
+		Filter:  &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}, Visible: proto.Bool(true)},
+		OrderBy: "advertised_start_time desc",
+	}
+
+	tests := []struct {
+		name string
+		req  *racing.ListRacesRequest
+		same bool
+	}{
+		{
+			// Paging through results changes only the page token and size.
+			name: "another page",
+			req: &racing.ListRacesRequest{
+				Filter:    &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}, Visible: proto.Bool(true)},
+				OrderBy:   "advertised_start_time desc",
+				PageSize:  10,
+				PageToken: "token",
+			},
+			same: true,
+		},
+		{
+			name: "different meetings",
+			req: &racing.ListRacesRequest{
+				Filter:  &racing.ListRacesRequestFilter{MeetingIds: []int64{1}, Visible: proto.Bool(true)},
+				OrderBy: "advertised_start_time desc",
+			},
+		},
+		{
+			name: "different visibility",
+			req: &racing.ListRacesRequest{
+				Filter:  &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}},
+				OrderBy: "advertised_start_time desc",
+			},
+		},
+		{
+			name: "different order",
+			req: &racing.ListRacesRequest{
+				Filter:  &racing.ListRacesRequestFilter{MeetingIds: []int64{1, 2}, Visible: proto.Bool(true)},
+				OrderBy: "advertised_start_time",
+			},
+		},
+		{
+			name: "no filter",
+			req:  &racing.ListRacesRequest{OrderBy: "advertised_start_time desc"},
+		},
+	}
+
+	want, err := listRacesQuery(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listRacesQuery(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (got == want) != tt.same {
+				t.Errorf("listRacesQuery = %q, base query %q, want same = %t", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func mustEncode(t *testing.T, codec pageTokenCodec, query string, cursor *db.Cursor) string {
+	t.Helper()
+
+	token, err := codec.encode(query, cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// splitToken returns a token's payload and signature.
+func splitToken(t *testing.T, token string) (string, string) {
+	t.Helper()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		t.Fatalf("token %q has %d parts, want 2", token, len(parts))
+	}
+
+	return parts[0], parts[1]
+}
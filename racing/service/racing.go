@@ -1,31 +1,291 @@
 package service
 
 import (
+	"errors"
+
 	"git.neds.sh/matty/entain/racing/db"
 	"git.neds.sh/matty/entain/racing/proto/racing"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 type Racing interface {
 	// ListRaces will return a collection of races.
 	ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error)
+
+	// GetRace will return a single race by its ID.
+	GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error)
+
+	// CreateRace will create a new race.
+	CreateRace(ctx context.Context, in *racing.CreateRaceRequest) (*racing.Race, error)
+
+	// UpdateRace will modify the fields of an existing race named by its update mask.
+	UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.Race, error)
+
+	// DeleteRace will delete a race, along with its runners.
+	DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*emptypb.Empty, error)
+
+	// WatchRaces will stream a snapshot of races, followed by changes to them.
+	WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error
+
+	// ListRunners will return the runners of a single race.
+	ListRunners(ctx context.Context, in *racing.ListRunnersRequest) (*racing.ListRunnersResponse, error)
+
+	// ListMeetings will return a collection of meetings.
+	ListMeetings(ctx context.Context, in *racing.ListMeetingsRequest) (*racing.ListMeetingsResponse, error)
+
+	// GetMeeting will return a single meeting by its ID.
+	GetMeeting(ctx context.Context, in *racing.GetMeetingRequest) (*racing.Meeting, error)
 }
 
+const (
+	// defaultPageSize is used when a ListRaces caller doesn't set page_size.
+	defaultPageSize = 100
+
+	// maxPageSize is the largest page_size a ListRaces caller may request.
+	maxPageSize = 1000
+)
+
 // racingService implements the Racing interface.
 type racingService struct {
-	racesRepo db.RacesRepo
+	racesRepo    db.RacesRepo
+	meetingsRepo db.MeetingsRepo
+	runnersRepo  db.RunnersRepo
+	pageTokens   pageTokenCodec
 }
 
-// NewRacingService instantiates and returns a new racingService.
-func NewRacingService(racesRepo db.RacesRepo) Racing {
-	return &racingService{racesRepo}
+// NewRacingService instantiates and returns a new racingService. The
+// pageTokenKey signs ListRaces page tokens, and must be shared by every
+// replica serving the same clients.
+func NewRacingService(racesRepo db.RacesRepo, meetingsRepo db.MeetingsRepo, runnersRepo db.RunnersRepo, pageTokenKey []byte) Racing {
+	return &racingService{racesRepo, meetingsRepo, runnersRepo, pageTokenCodec{pageTokenKey}}
 }
 
 func (s *racingService) ListRaces(ctx context.Context, in *racing.ListRacesRequest) (*racing.ListRacesResponse, error) {
-	races, err := s.racesRepo.List(in.Filter)
+	opts := db.ListOptions{OrderBy: in.OrderBy, PageSize: int(in.PageSize)}
+
+	switch {
+	case in.PageSize < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	case in.PageSize == 0:
+		opts.PageSize = defaultPageSize
+	case in.PageSize > maxPageSize:
+		opts.PageSize = maxPageSize
+	}
+
+	query, err := listRacesQuery(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.PageToken != "" {
+		opts.After, err = s.pageTokens.decode(query, in.PageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	races, next, err := s.racesRepo.List(ctx, in.Filter, opts)
+	if errors.Is(err, db.ErrInvalidArgument) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if in.IncludeMeeting {
+		if err := s.embedMeetings(races); err != nil {
+			return nil, err
+		}
+	}
+
+	if in.IncludeRunners {
+		if err := s.embedRunners(races); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &racing.ListRacesResponse{Races: races}
+	if next != nil {
+		resp.NextPageToken, err = s.pageTokens.encode(query, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+func (s *racingService) GetRace(ctx context.Context, in *racing.GetRaceRequest) (*racing.Race, error) {
+	race, err := s.racesRepo.Get(in.Id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", in.Id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if in.IncludeRunners {
+		if err := s.embedRunners([]*racing.Race{race}); err != nil {
+			return nil, err
+		}
+	}
+
+	return race, nil
+}
+
+func (s *racingService) CreateRace(ctx context.Context, in *racing.CreateRaceRequest) (*racing.Race, error) {
+	if in.Race == nil {
+		return nil, status.Error(codes.InvalidArgument, "race is required")
+	}
+
+	if err := s.validateRace(in.Race, db.UpdatableRaceFields()); err != nil {
+		return nil, err
+	}
+
+	return s.racesRepo.Create(in.Race)
+}
+
+func (s *racingService) UpdateRace(ctx context.Context, in *racing.UpdateRaceRequest) (*racing.Race, error) {
+	if in.Race == nil {
+		return nil, status.Error(codes.InvalidArgument, "race is required")
+	}
+
+	fields, err := updateMaskFields(in.UpdateMask)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validateRace(in.Race, fields); err != nil {
+		return nil, err
+	}
+
+	race, err := s.racesRepo.Update(in.Race, fields)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", in.Race.Id)
+	}
+	if errors.Is(err, db.ErrEtagMismatch) {
+		return nil, status.Errorf(codes.Aborted, "race %d has been modified since etag %q", in.Race.Id, in.Race.Etag)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return race, nil
+}
+
+func (s *racingService) DeleteRace(ctx context.Context, in *racing.DeleteRaceRequest) (*emptypb.Empty, error) {
+	err := s.racesRepo.Delete(in.Id, in.Etag)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "race %d not found", in.Id)
+	}
+	if errors.Is(err, db.ErrEtagMismatch) {
+		return nil, status.Errorf(codes.Aborted, "race %d has been modified since etag %q", in.Id, in.Etag)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *racingService) ListRunners(ctx context.Context, in *racing.ListRunnersRequest) (*racing.ListRunnersResponse, error) {
+	if _, err := s.racesRepo.Get(in.RaceId); err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, status.Errorf(codes.NotFound, "race %d not found", in.RaceId)
+		}
+
+		return nil, err
+	}
+
+	runners, err := s.runnersRepo.List([]int64{in.RaceId})
+	if err != nil {
+		return nil, err
+	}
+
+	return &racing.ListRunnersResponse{Runners: runners}, nil
+}
+
+func (s *racingService) ListMeetings(ctx context.Context, in *racing.ListMeetingsRequest) (*racing.ListMeetingsResponse, error) {
+	meetings, err := s.meetingsRepo.List(in.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &racing.ListMeetingsResponse{Meetings: meetings}, nil
+}
+
+func (s *racingService) GetMeeting(ctx context.Context, in *racing.GetMeetingRequest) (*racing.Meeting, error) {
+	meeting, err := s.meetingsRepo.Get(in.Id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "meeting %d not found", in.Id)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return &racing.ListRacesResponse{Races: races}, nil
+	return meeting, nil
+}
+
+// embedMeetings sets each race's parent meeting, loading all of them in a
+// single query.
+func (s *racingService) embedMeetings(races []*racing.Race) error {
+	if len(races) == 0 {
+		return nil
+	}
+
+	filter := &racing.ListMeetingsRequestFilter{}
+	seen := make(map[int64]bool, len(races))
+	for _, race := range races {
+		if !seen[race.MeetingId] {
+			seen[race.MeetingId] = true
+			filter.Ids = append(filter.Ids, race.MeetingId)
+		}
+	}
+
+	meetings, err := s.meetingsRepo.List(filter)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int64]*racing.Meeting, len(meetings))
+	for _, meeting := range meetings {
+		byID[meeting.Id] = meeting
+	}
+
+	for _, race := range races {
+		race.Meeting = byID[race.MeetingId]
+	}
+
+	return nil
+}
+
+// embedRunners sets each race's runners, loading all of them in a single
+// query rather than one per race.
+func (s *racingService) embedRunners(races []*racing.Race) error {
+	if len(races) == 0 {
+		return nil
+	}
+
+	raceIDs := make([]int64, 0, len(races))
+	byID := make(map[int64]*racing.Race, len(races))
+	for _, race := range races {
+		raceIDs = append(raceIDs, race.Id)
+		byID[race.Id] = race
+	}
+
+	runners, err := s.runnersRepo.List(raceIDs)
+	if err != nil {
+		return err
+	}
+
+	for _, runner := range runners {
+		if race, ok := byID[runner.RaceId]; ok {
+			race.Runners = append(race.Runners, runner)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"errors"
+	"strings"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// updateMaskFields returns the race fields named by an UpdateRace mask. An
+// empty mask, or "*", names every updatable field.
+func updateMaskFields(mask *fieldmaskpb.FieldMask) ([]string, error) {
+	updatable := db.UpdatableRaceFields()
+
+	if len(mask.GetPaths()) == 0 {
+		return updatable, nil
+	}
+
+	var fields []string
+	for _, path := range mask.GetPaths() {
+		if path == "*" {
+			return updatable, nil
+		}
+
+		// The etag is a precondition on the update rather than a field to
+		// write, but is included in masks the gateway infers from a body.
+		if path == "etag" {
+			continue
+		}
+
+		if !contains(updatable, path) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot update field %q, updatable fields are %s", path, strings.Join(updatable, ", "))
+		}
+
+		fields = append(fields, path)
+	}
+
+	return fields, nil
+}
+
+// validateRace checks the given fields of race hold acceptable values.
+func (s *racingService) validateRace(race *racing.Race, fields []string) error {
+	for _, field := range fields {
+		switch field {
+		case "meeting_id":
+			if _, err := s.meetingsRepo.Get(race.MeetingId); errors.Is(err, db.ErrNotFound) {
+				return status.Errorf(codes.InvalidArgument, "meeting %d does not exist", race.MeetingId)
+			} else if err != nil {
+				return err
+			}
+		case "name":
+			if strings.TrimSpace(race.Name) == "" {
+				return status.Error(codes.InvalidArgument, "race name is required")
+			}
+		case "number":
+			if race.Number <= 0 {
+				return status.Error(codes.InvalidArgument, "race number must be positive")
+			}
+		case "advertised_start_time":
+			if !race.AdvertisedStartTime.IsValid() {
+				return status.Error(codes.InvalidArgument, "race advertised_start_time is required")
+			}
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
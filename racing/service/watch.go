@@ -0,0 +1,93 @@
+package service
+
+import (
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchEventTypes maps change feed types onto their WatchRaces event types.
+var watchEventTypes = map[db.ChangeType]racing.WatchRacesResponse_EventType{
+	db.ChangeCreated: racing.WatchRacesResponse_CREATED,
+	db.ChangeUpdated: racing.WatchRacesResponse_UPDATED,
+	db.ChangeClosed:  racing.WatchRacesResponse_CLOSED,
+	db.ChangeDeleted: racing.WatchRacesResponse_DELETED,
+}
+
+// WatchRaces subscribes to the change feed before taking its snapshot, so no
+// change is missed in between. A change made while the snapshot is being
+// sent may therefore be delivered twice, once in the snapshot and again as
+// an event, so clients should treat events as upserts keyed by race ID.
+func (s *racingService) WatchRaces(in *racing.WatchRacesRequest, stream racing.Racing_WatchRacesServer) error {
+	sub := s.racesRepo.Subscribe(in.ResumeAfter)
+	defer sub.Close()
+
+	if sub.Resumed() {
+		for _, change := range sub.Replay() {
+			if err := sendChange(stream, in.Filter, change); err != nil {
+				return err
+			}
+		}
+	} else if err := s.sendSnapshot(stream, in.Filter, sub.Seq()); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case change, ok := <-sub.C():
+			if !ok {
+				if sub.Dropped() {
+					return status.Error(codes.ResourceExhausted, "watcher fell too far behind, please reconnect")
+				}
+
+				return status.Error(codes.Unavailable, "race change feed closed")
+			}
+
+			if err := sendChange(stream, in.Filter, change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendSnapshot sends every race matching filter, followed by a
+// SNAPSHOT_COMPLETE marker.
+func (s *racingService) sendSnapshot(stream racing.Racing_WatchRacesServer, filter *racing.ListRacesRequestFilter, seq uint64) error {
+	races, _, err := s.racesRepo.List(stream.Context(), filter, db.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, race := range races {
+		if err := stream.Send(&racing.WatchRacesResponse{
+			Type:     racing.WatchRacesResponse_SNAPSHOT,
+			Race:     race,
+			Sequence: seq,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return stream.Send(&racing.WatchRacesResponse{
+		Type:     racing.WatchRacesResponse_SNAPSHOT_COMPLETE,
+		Sequence: seq,
+	})
+}
+
+// sendChange sends a change, so long as its race matches filter either
+// before or after it. A race which no longer matches is still sent, with its
+// new state, so that clients know to drop it.
+func sendChange(stream racing.Racing_WatchRacesServer, filter *racing.ListRacesRequestFilter, change db.Change) error {
+	if !db.MatchesFilter(change.Race, filter) && (change.Previous == nil || !db.MatchesFilter(change.Previous, filter)) {
+		return nil
+	}
+
+	return stream.Send(&racing.WatchRacesResponse{
+		Type:     watchEventTypes[change.Type],
+		Race:     change.Race,
+		Sequence: change.Seq,
+	})
+}
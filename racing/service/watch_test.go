@@ -0,0 +1,96 @@
+package service
+
+import (
+	"testing"
+
+	"git.neds.sh/matty/entain/racing/db"
+	"git.neds.sh/matty/entain/racing/proto/racing"
+	"google.golang.org/grpc"
+)
+
+// sentStream records the events sent on a WatchRaces stream.
+type sentStream struct {
+	grpc.ServerStream
+	sent []*racing.WatchRacesResponse
+}
+
+func (s *sentStream) Send(resp *racing.WatchRacesResponse) error {
+	s.sent = append(s.sent, resp)
+	return nil
+}
+
+func TestSendChange(t *testing.T) {
+	open := &racing.Race{Id: 1, MeetingId: 1, Visible: true, Status: racing.Race_OPEN}
+	closed := &racing.Race{Id: 1, MeetingId: 1, Visible: true, Status: racing.Race_CLOSED}
+	hidden := &racing.Race{Id: 1, MeetingId: 1, Visible: false, Status: racing.Race_OPEN}
+	moved := &racing.Race{Id: 1, MeetingId: 2, Visible: true, Status: racing.Race_OPEN}
+
+	visible := true
+
+	tests := []struct {
+		name   string
+		filter *racing.ListRacesRequestFilter
+		change db.Change
+		sent   bool
+	}{
+		{
+			name:   "created matching",
+			filter: &racing.ListRacesRequestFilter{Status: racing.Race_OPEN},
+			change: db.Change{Type: db.ChangeCreated, Race: open},
+			sent:   true,
+		},
+		{
+			name:   "created not matching",
+			filter: &racing.ListRacesRequestFilter{Status: racing.Race_CLOSED},
+			change: db.Change{Type: db.ChangeCreated, Race: open},
+		},
+		{
+			name:   "closed while watching open races",
+			filter: &racing.ListRacesRequestFilter{Status: racing.Race_OPEN},
+			change: db.Change{Type: db.ChangeClosed, Race: closed, Previous: open},
+			sent:   true,
+		},
+		{
+			name:   "hidden while watching visible races",
+			filter: &racing.ListRacesRequestFilter{Visible: &visible},
+			change: db.Change{Type: db.ChangeUpdated, Race: hidden, Previous: open},
+			sent:   true,
+		},
+		{
+			name:   "moved to another meeting",
+			filter: &racing.ListRacesRequestFilter{MeetingIds: []int64{1}},
+			change: db.Change{Type: db.ChangeUpdated, Race: moved, Previous: open},
+			sent:   true,
+		},
+		{
+			name:   "updated without ever matching",
+			filter: &racing.ListRacesRequestFilter{Visible: &visible},
+			change: db.Change{Type: db.ChangeUpdated, Race: hidden, Previous: hidden},
+		},
+		{
+			name:   "deleted matching",
+			filter: &racing.ListRacesRequestFilter{Status: racing.Race_OPEN},
+			change: db.Change{Type: db.ChangeDeleted, Race: open},
+			sent:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &sentStream{}
+
+			if err := sendChange(stream, tt.filter, tt.change); err != nil {
+				t.Fatalf("sendChange: %s", err)
+			}
+
+			if sent := len(stream.sent) == 1; sent != tt.sent {
+				t.Fatalf("sent = %v, want %v", sent, tt.sent)
+			}
+
+			if tt.sent && stream.sent[0].Race != tt.change.Race {
+				t.Errorf("sent race %v, want the race's new state %v", stream.sent[0].Race, tt.change.Race)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/tlsreload"
+	"git.neds.sh/matty/entain/internal/platform/tlstest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+// serveTLS serves the health service over TLS with serverCredentials, until
+// the test ends.
+func serveTLS(t *testing.T, certFile, keyFile, clientCAFile string) string {
+	t.Helper()
+
+	creds, err := serverCredentials(certFile, keyFile, clientCAFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer(creds)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	return ln.Addr().String()
+}
+
+// check calls the health service at addr over TLS, as the gateway would,
+// returning the certificate the server presented.
+func check(t *testing.T, addr, certFile, keyFile, caFile string) ([]byte, error) {
+	t.Helper()
+
+	files, err := tlsreload.Load(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(tlsreload.ClientConfig(files, "localhost"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var p peer.Peer
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.Peer(&p)); err != nil {
+		return nil, err
+	}
+
+	return p.AuthInfo.(credentials.TLSInfo).State.PeerCertificates[0].Raw, nil
+}
+
+func TestServerCredentials(t *testing.T) {
+	certs := tlstest.New(t, "localhost")
+	addr := serveTLS(t, certs.ServerCert, certs.ServerKey, "")
+
+	if _, err := check(t, addr, "", "", certs.CA); err != nil {
+		t.Fatalf("check over TLS: %s", err)
+	}
+
+	other := tlstest.New(t, "localhost")
+	if _, err := check(t, addr, "", "", other.CA); err == nil {
+		t.Error("check trusting another CA succeeded, want it refused")
+	}
+}
+
+func TestServerCredentialsMutualTLS(t *testing.T) {
+	certs := tlstest.New(t, "localhost")
+	addr := serveTLS(t, certs.ServerCert, certs.ServerKey, certs.CA)
+
+	if _, err := check(t, addr, certs.ClientCert, certs.ClientKey, certs.CA); err != nil {
+		t.Fatalf("check with a client certificate: %s", err)
+	}
+
+	if _, err := check(t, addr, "", "", certs.CA); err == nil {
+		t.Error("check without a client certificate succeeded, want it refused")
+	}
+}
+
+func TestServerCredentialsReload(t *testing.T) {
+	dir := t.TempDir()
+
+	certs, err := tlstest.Generate(dir, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTLS(t, certs.ServerCert, certs.ServerKey, certs.CA)
+
+	before, err := check(t, addr, certs.ClientCert, certs.ClientKey, certs.CA)
+	if err != nil {
+		t.Fatalf("check: %s", err)
+	}
+
+	// Reissue every certificate, the CA included, in place, and give the
+	// server time to notice.
+	if _, err := tlstest.Generate(dir, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(tlsreload.ReloadInterval + 100*time.Millisecond)
+
+	after, err := check(t, addr, certs.ClientCert, certs.ClientKey, certs.CA)
+	if err != nil {
+		t.Fatalf("check with the reissued certificates: %s", err)
+	}
+
+	reissued, err := ioutil.ReadFile(certs.ServerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(after, before) {
+		t.Fatal("server presented the old certificate after reloading")
+	}
+	if block, _ := pem.Decode(reissued); block == nil || !bytes.Equal(after, block.Bytes) {
+		t.Error("server presented a certificate other than the reissued one")
+	}
+}
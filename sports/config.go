@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"time"
+
+	"git.neds.sh/matty/entain/internal/platform/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// envPrefix prefixes the environment variable each flag can be set with,
+// e.g. SPORTS_DB_PATH for --db-path.
+const envPrefix = "SPORTS_"
+
+var (
+	configFile = flag.String(config.FileFlag, "", "YAML or JSON file of settings, keyed by flag name (also "+envPrefix+"CONFIG)")
+	logLevel   = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error")
+)
+
+// loadConfig fills in flags not given on the command line, from environment
+// variables and then the config file, and validates them. It must be called
+// after flag.Parse.
+func loadConfig() error {
+	if err := config.Load(flag.CommandLine, envPrefix); err != nil {
+		return err
+	}
+
+	return validateConfig()
+}
+
+// validateConfig checks settings which are well formed, but may not make
+// sense, and applies --log-level.
+func validateConfig() error {
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	log.SetLevel(level)
+
+	if _, _, err := net.SplitHostPort(*grpcEndpoint); err != nil {
+		return fmt.Errorf("invalid --grpc-endpoint: %w", err)
+	}
+
+	if *dbPath == "" {
+		return fmt.Errorf("--db-path can't be empty")
+	}
+
+	if *seedDate != "" {
+		if _, err := time.Parse(seedDateLayout, *seedDate); err != nil {
+			return fmt.Errorf("invalid --seed-date %q, expected YYYY-MM-DD", *seedDate)
+		}
+	}
+
+	return nil
+}
+
+// logConfig logs the value of every setting. Sports has no secret ones.
+func logConfig() {
+	config.Log(flag.CommandLine, nil)
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"syreclabs.com/go/faker"
+)
+
+// competitions lists some example competitions for each sport, used to seed
+// realistic looking events.
+var competitions = map[sports.Event_SportType][]string{
+	sports.Event_SOCCER:           {"A-League", "English Premier League", "UEFA Champions League"},
+	sports.Event_BASKETBALL:       {"NBA", "NBL", "EuroLeague"},
+	sports.Event_TENNIS:           {"Australian Open", "Wimbledon", "US Open"},
+	sports.Event_CRICKET:          {"Big Bash League", "Indian Premier League", "The Ashes"},
+	sports.Event_AUSTRALIAN_RULES: {"AFL", "AFLW"},
+	sports.Event_RUGBY_LEAGUE:     {"NRL", "State of Origin", "Super League"},
+}
+
+// seedEvents is how many events are generated.
+const seedEvents = 100
+
+// GenerateEvents returns random events. The same seed value and day always
+// generate the same events, starting from the day before day until the day
+// after.
+func GenerateEvents(seed int64, day time.Time) []*sports.Event {
+	faker.Seed(seed)
+
+	// Times are generated to the second, with both bounds inclusive.
+	day = day.UTC().Truncate(24 * time.Hour)
+	from, until := day.AddDate(0, 0, -1), day.AddDate(0, 0, 2).Add(-time.Second)
+
+	events := make([]*sports.Event, 0, seedEvents)
+	for id := int64(1); id <= seedEvents; id++ {
+		sportType := sports.Event_SportType(faker.RandomInt(1, len(competitions)))
+		start := faker.Time().Between(from, until).UTC()
+
+		events = append(events, &sports.Event{
+			Id:                  id,
+			Name:                faker.Team().Name() + " vs " + faker.Team().Name(),
+			AdvertisedStartTime: timestamppb.New(start),
+			Competition:         faker.RandomChoice(competitions[sportType]),
+			SportType:           sportType,
+			Visible:             faker.RandomInt(0, 1) == 1,
+		})
+	}
+
+	return events
+}
+
+// Seed inserts events into the database in a single transaction. Events
+// which already exist are left untouched, so seeding is safe to repeat.
+func Seed(db *sql.DB, events []*sports.Event) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO events(id, name, advertised_start_time, competition, sport_type, visible) VALUES (?,?,?,?,?,?) ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, event := range events {
+		if _, err := insert.Exec(
+			event.Id,
+			event.Name,
+			event.AdvertisedStartTime.AsTime().UTC().Format(time.RFC3339),
+			event.Competition,
+			int32(event.SportType),
+			event.Visible,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
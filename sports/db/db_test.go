@@ -0,0 +1,180 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// openDB opens an empty SQLite database for the test.
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func userVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+
+	return version
+}
+
+func TestMigrate(t *testing.T) {
+	db := openDB(t)
+
+	for i := 0; i < 2; i++ {
+		if err := Migrate(db); err != nil {
+			t.Fatalf("Migrate #%d: %s", i+1, err)
+		}
+	}
+
+	if got := userVersion(t, db); got != 1 {
+		t.Errorf("user_version = %d, want 1", got)
+	}
+
+	events, err := NewEventsRepo(db).List(nil)
+	if err != nil {
+		t.Fatalf("listing a migrated database: %s", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("listed %d events, want none until seeded", len(events))
+	}
+}
+
+func TestMigrateAdoptsExistingTable(t *testing.T) {
+	db := openDB(t)
+
+	// Databases from before migrations had the table created on start.
+	if _, err := db.Exec(`CREATE TABLE events (id INTEGER PRIMARY KEY, name TEXT, advertised_start_time DATETIME, competition TEXT, sport_type INTEGER, visible INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO events VALUES (1, 'Carlton vs Collingwood', '2030-01-01T09:00:00Z', 'AFL', 5, 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db); err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+
+	events, err := NewEventsRepo(db).List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Name != "Carlton vs Collingwood" {
+		t.Errorf("events after migrating = %v, want the existing event kept", events)
+	}
+}
+
+func TestMigrateSchemaAhead(t *testing.T) {
+	db := openDB(t)
+
+	if _, err := db.Exec(`PRAGMA user_version = 99`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Migrate(db); !errors.Is(err, ErrSchemaAhead) {
+		t.Errorf("Migrate = %v, want %v", err, ErrSchemaAhead)
+	}
+	if got := userVersion(t, db); got != 99 {
+		t.Errorf("user_version = %d, want it left at 99", got)
+	}
+}
+
+func TestGenerateEvents(t *testing.T) {
+	day := time.Date(2030, time.January, 1, 15, 30, 0, 0, time.FixedZone("AEDT", 11*60*60))
+
+	events := GenerateEvents(1, day)
+	if len(events) != seedEvents {
+		t.Fatalf("generated %d events, want %d", len(events), seedEvents)
+	}
+
+	again := GenerateEvents(1, day)
+	for i := range events {
+		if !proto.Equal(events[i], again[i]) {
+			t.Fatalf("event %d = %v, then %v, want the same seed to generate the same events", i, events[i], again[i])
+		}
+	}
+
+	other := GenerateEvents(2, day)
+	same := true
+	for i := range events {
+		same = same && proto.Equal(events[i], other[i])
+	}
+	if same {
+		t.Error("seeds 1 and 2 generated the same events")
+	}
+
+	// Days are UTC, so 2030-01-01 AEDT is 2030-01-01 UTC.
+	from := time.Date(2029, time.December, 31, 0, 0, 0, 0, time.UTC)
+	until := time.Date(2030, time.January, 3, 0, 0, 0, 0, time.UTC)
+
+	for _, event := range events {
+		start := event.AdvertisedStartTime.AsTime()
+		if start.Before(from) || !start.Before(until) {
+			t.Errorf("event %d starts %s, want within [%s, %s)", event.Id, start, from, until)
+		}
+
+		found := false
+		for _, competition := range competitions[event.SportType] {
+			found = found || competition == event.Competition
+		}
+		if !found {
+			t.Errorf("event %d is %s in %q, which isn't one of its competitions", event.Id, event.SportType, event.Competition)
+		}
+	}
+}
+
+func TestSeed(t *testing.T) {
+	db := openDB(t)
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []*sports.Event{
+		{Id: 1, Name: "Carlton vs Collingwood", AdvertisedStartTime: timestamppb.New(time.Date(2030, time.January, 1, 9, 0, 0, 0, time.UTC)), Competition: "AFL", SportType: sports.Event_AUSTRALIAN_RULES, Visible: true},
+		{Id: 2, Name: "Sydney vs Perth", AdvertisedStartTime: timestamppb.New(time.Date(2030, time.January, 1, 8, 0, 0, 0, time.UTC)), Competition: "A-League", SportType: sports.Event_SOCCER},
+	}
+	if err := Seed(db, events); err != nil {
+		t.Fatalf("Seed: %s", err)
+	}
+
+	// Seeding again leaves existing events alone.
+	if _, err := db.Exec(`UPDATE events SET name = 'Renamed' WHERE id = 1`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Seed(db, events); err != nil {
+		t.Fatalf("Seed again: %s", err)
+	}
+
+	got, err := NewEventsRepo(db).List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("listed %d events, want 2", len(got))
+	}
+
+	if !proto.Equal(got[0], events[1]) {
+		t.Errorf("event = %v, want %v", got[0], events[1])
+	}
+	if got[1].Name != "Renamed" {
+		t.Errorf("event 1 named %q after seeding again, want it left as Renamed", got[1].Name)
+	}
+}
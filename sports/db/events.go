@@ -0,0 +1,108 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/golang/protobuf/ptypes"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+	"time"
+
+	"git.neds.sh/matty/entain/sports/proto/sports"
+)
+
+// EventsRepo provides repository access to sports events.
+type EventsRepo interface {
+	// List will return a list of events, ordered by their advertised start time.
+	List(filter *sports.ListEventsRequestFilter) ([]*sports.Event, error)
+}
+
+type eventsRepo struct {
+	db *sql.DB
+}
+
+// NewEventsRepo creates a new events repository, over a database which
+// has been migrated.
+func NewEventsRepo(db *sql.DB) EventsRepo {
+	return &eventsRepo{db: db}
+}
+
+func (r *eventsRepo) List(filter *sports.ListEventsRequestFilter) ([]*sports.Event, error) {
+	var (
+		err   error
+		query string
+		args  []interface{}
+	)
+
+	query = getEventQueries()[eventsList]
+
+	query, args = r.applyFilter(query, filter)
+
+	query += " ORDER BY advertised_start_time, id"
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.scanEvents(rows)
+}
+
+func (r *eventsRepo) applyFilter(query string, filter *sports.ListEventsRequestFilter) (string, []interface{}) {
+	var (
+		clauses []string
+		args    []interface{}
+	)
+
+	if filter == nil {
+		return query, args
+	}
+
+	if len(filter.SportTypes) > 0 {
+		clauses = append(clauses, "sport_type IN ("+strings.Repeat("?,", len(filter.SportTypes)-1)+"?)")
+
+		for _, sportType := range filter.SportTypes {
+			args = append(args, int32(sportType))
+		}
+	}
+
+	if filter.Visible != nil {
+		clauses = append(clauses, "visible = ?")
+		args = append(args, *filter.Visible)
+	}
+
+	if len(clauses) != 0 {
+		query += " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	return query, args
+}
+
+func (m *eventsRepo) scanEvents(
+	rows *sql.Rows,
+) ([]*sports.Event, error) {
+	var events []*sports.Event
+
+	for rows.Next() {
+		var event sports.Event
+		var advertisedStart time.Time
+
+		if err := rows.Scan(&event.Id, &event.Name, &advertisedStart, &event.Competition, &event.SportType, &event.Visible); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		ts, err := ptypes.TimestampProto(advertisedStart)
+		if err != nil {
+			return nil, err
+		}
+
+		event.AdvertisedStartTime = ts
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
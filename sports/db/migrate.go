@@ -0,0 +1,110 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// ErrSchemaAhead is returned when the database has migrations applied which
+// this binary doesn't know about, i.e. it was migrated by a newer release.
+var ErrSchemaAhead = errors.New("database schema is ahead of this binary")
+
+// migration is a single, versioned change to the schema, kept in
+// migrations/ as NNNN_name.sql.
+type migration struct {
+	version int
+	name    string
+	script  string
+}
+
+// loadMigrations returns the embedded migrations, ordered by version, which
+// must run from 1 without gaps.
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version", entry.Name())
+		}
+
+		script, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, script: string(script)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			return nil, fmt.Errorf("migration %s is out of sequence, expected version %d", m.name, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Migrate applies every migration the database is yet to have, each in its
+// own transaction. The version it has reached is kept in SQLite's
+// user_version, so migrations already applied are skipped on later starts.
+func Migrate(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		return err
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("%w: at version %d, expected at most %d", ErrSchemaAhead, current, len(migrations))
+	}
+
+	for _, m := range migrations[current:] {
+		if err := apply(db, m); err != nil {
+			return fmt.Errorf("failed applying migration %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func apply(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.script); err != nil {
+		return err
+	}
+
+	// PRAGMA doesn't take parameters, but the version is our own integer.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,10 @@
+-- Databases created before migrations were introduced already have this
+-- table, so it is adopted rather than recreated.
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY,
+    name TEXT,
+    advertised_start_time DATETIME,
+    competition TEXT,
+    sport_type INTEGER,
+    visible INTEGER
+);
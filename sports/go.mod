@@ -0,0 +1,26 @@
+module git.neds.sh/matty/entain/sports
+
+go 1.19
+
+require (
+	git.neds.sh/matty/entain/internal/platform v0.0.0
+	github.com/golang/protobuf v1.5.3
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.15.2
+	github.com/mattn/go-sqlite3 v1.14.15
+	github.com/sirupsen/logrus v1.8.0
+	golang.org/x/net v0.11.0
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1
+	google.golang.org/grpc v1.54.0
+	google.golang.org/grpc/cmd/protoc-gen-go-grpc v1.1.0
+	google.golang.org/protobuf v1.30.0
+	syreclabs.com/go/faker v1.2.3
+)
+
+require (
+	github.com/golang/glog v1.0.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace git.neds.sh/matty/entain/internal/platform => ../internal/platform
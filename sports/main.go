@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"git.neds.sh/matty/entain/sports/db"
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"git.neds.sh/matty/entain/sports/service"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"net"
+	"time"
+)
+
+var (
+	grpcEndpoint = flag.String("grpc-endpoint", ":9001", "gRPC server endpoint")
+	dbPath       = flag.String("db-path", "./db/sports.db", "SQLite database file events are stored in, created when missing")
+	seed         = flag.Bool("seed", false, "Seed the database with generated events on start")
+	seedValue    = flag.Int64("seed-value", 0, "Random seed for generated events, for reproducible fixtures (random when 0)")
+	seedDate     = flag.String("seed-date", "", "Day generated events are scheduled around, as YYYY-MM-DD, so --seed-value reproduces the same events whenever it's run (today when empty)")
+)
+
+// seedDateLayout is the layout of --seed-date.
+const seedDateLayout = "2006-01-02"
+
+func main() {
+	flag.Parse()
+
+	if err := loadConfig(); err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
+	if err := run(); err != nil {
+		log.Fatalf("failed running grpc server: %s", err)
+	}
+}
+
+func run() error {
+	logConfig()
+
+	conn, err := net.Listen("tcp", *grpcEndpoint)
+	if err != nil {
+		return err
+	}
+
+	sportsDB, err := sql.Open("sqlite3", *dbPath)
+	if err != nil {
+		return err
+	}
+
+	// Pending migrations are applied on start, but a database migrated by a
+	// newer release is left alone rather than served from.
+	if err := db.Migrate(sportsDB); err != nil {
+		return err
+	}
+
+	if *seed {
+		if err := db.Seed(sportsDB, generateEvents()); err != nil {
+			return err
+		}
+	}
+
+	eventsRepo := db.NewEventsRepo(sportsDB)
+
+	grpcServer := grpc.NewServer()
+
+	sports.RegisterSportsServer(
+		grpcServer,
+		service.NewSportsService(
+			eventsRepo,
+		),
+	)
+
+	log.Infof("gRPC server listening on: %s", *grpcEndpoint)
+
+	if err := grpcServer.Serve(conn); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// generateEvents returns the events to seed the database with, generated
+// from --seed-value and --seed-date.
+func generateEvents() []*sports.Event {
+	value := *seedValue
+	if value == 0 {
+		value = time.Now().UnixNano()
+	}
+
+	day := time.Now()
+	if *seedDate != "" {
+		// Checked by validateConfig.
+		day, _ = time.Parse(seedDateLayout, *seedDate)
+	}
+
+	log.Infof("seeding database with --seed-value=%d --seed-date=%s", value, day.UTC().Format(seedDateLayout))
+
+	return db.GenerateEvents(value, day)
+}
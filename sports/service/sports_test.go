@@ -0,0 +1,132 @@
+package service
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.neds.sh/matty/entain/sports/db"
+	"git.neds.sh/matty/entain/sports/proto/sports"
+	"golang.org/x/net/context"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// newSportsService serves events from a fresh database.
+func newSportsService(t *testing.T, events []*sports.Event) Sports {
+	t.Helper()
+
+	sportsDB, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sportsDB.Close() })
+
+	if err := db.Migrate(sportsDB); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Seed(sportsDB, events); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSportsService(db.NewEventsRepo(sportsDB))
+}
+
+func TestListEvents(t *testing.T) {
+	at := func(hour int) *timestamppb.Timestamp {
+		return timestamppb.New(time.Date(2030, time.January, 1, hour, 0, 0, 0, time.UTC))
+	}
+
+	// Inserted out of order, with events 2 and 4 starting together.
+	events := []*sports.Event{
+		{Id: 4, Name: "Sydney vs Perth", AdvertisedStartTime: at(9), Competition: "A-League", SportType: sports.Event_SOCCER, Visible: true},
+		{Id: 1, Name: "Carlton vs Collingwood", AdvertisedStartTime: at(12), Competition: "AFL", SportType: sports.Event_AUSTRALIAN_RULES, Visible: true},
+		{Id: 3, Name: "Djokovic vs Nadal", AdvertisedStartTime: at(7), Competition: "Australian Open", SportType: sports.Event_TENNIS},
+		{Id: 2, Name: "Storm vs Panthers", AdvertisedStartTime: at(9), Competition: "NRL", SportType: sports.Event_RUGBY_LEAGUE, Visible: true},
+		{Id: 5, Name: "Swiatek vs Sabalenka", AdvertisedStartTime: at(8), Competition: "Australian Open", SportType: sports.Event_TENNIS, Visible: true},
+	}
+
+	tests := []struct {
+		name   string
+		filter *sports.ListEventsRequestFilter
+		want   []int64
+	}{
+		{
+			// Ordered by start time, then id.
+			name: "all",
+			want: []int64{3, 5, 2, 4, 1},
+		},
+		{
+			name:   "empty filter",
+			filter: &sports.ListEventsRequestFilter{},
+			want:   []int64{3, 5, 2, 4, 1},
+		},
+		{
+			name:   "one sport",
+			filter: &sports.ListEventsRequestFilter{SportTypes: []sports.Event_SportType{sports.Event_TENNIS}},
+			want:   []int64{3, 5},
+		},
+		{
+			name:   "several sports",
+			filter: &sports.ListEventsRequestFilter{SportTypes: []sports.Event_SportType{sports.Event_SOCCER, sports.Event_AUSTRALIAN_RULES}},
+			want:   []int64{4, 1},
+		},
+		{
+			name:   "visible",
+			filter: &sports.ListEventsRequestFilter{Visible: proto.Bool(true)},
+			want:   []int64{5, 2, 4, 1},
+		},
+		{
+			name:   "hidden",
+			filter: &sports.ListEventsRequestFilter{Visible: proto.Bool(false)},
+			want:   []int64{3},
+		},
+		{
+			name:   "visible of a sport",
+			filter: &sports.ListEventsRequestFilter{SportTypes: []sports.Event_SportType{sports.Event_TENNIS}, Visible: proto.Bool(true)},
+			want:   []int64{5},
+		},
+		{
+			name:   "no matches",
+			filter: &sports.ListEventsRequestFilter{SportTypes: []sports.Event_SportType{sports.Event_CRICKET}},
+		},
+	}
+
+	service := newSportsService(t, events)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := service.ListEvents(context.Background(), &sports.ListEventsRequest{Filter: tt.filter})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []int64
+			for _, event := range resp.Events {
+				got = append(got, event.Id)
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("listed events %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("listed events %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	// Events come back whole.
+	resp, err := service.ListEvents(context.Background(), &sports.ListEventsRequest{
+		Filter: &sports.ListEventsRequestFilter{Visible: proto.Bool(false)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 1 || !proto.Equal(resp.Events[0], events[2]) {
+		t.Errorf("listed %v, want %v", resp.Events, events[2])
+	}
+}